@@ -2,15 +2,21 @@ package function
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
-	"log"
 	"os"
-	"strings"
 
+	"github.com/automium/automium-gateway/pkg/apikey"
+	"github.com/automium/automium-gateway/pkg/audit"
+	"github.com/automium/automium-gateway/pkg/logging"
+	"github.com/automium/automium-gateway/pkg/metrics"
+	"github.com/automium/automium-gateway/pkg/notify"
+	"github.com/automium/automium-gateway/pkg/reporting"
+	"github.com/automium/automium-gateway/pkg/services"
+	"github.com/automium/automium-gateway/pkg/tracing"
 	types "github.com/automium/types/go/gateway"
 	v1beta1 "github.com/automium/types/go/v1beta1"
 
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/runtime/serializer"
 	"k8s.io/client-go/kubernetes/scheme"
@@ -18,6 +24,13 @@ import (
 	"k8s.io/client-go/tools/clientcmd"
 )
 
+var recorder = metrics.New("applyservice")
+var reporter = reporting.New("applyservice")
+var logger = logging.New("applyservice").TrackPhase(recorder.CurrentPhase)
+var requestTrace = tracing.FromEnv("applyservice")
+var auditor = audit.New("applyservice")
+var notifier = notify.New("applyservice")
+
 func getAPISecret(secretName string) (secretBytes []byte, err error) {
 	root := "/var/openfaas/secrets/"
 
@@ -28,16 +41,40 @@ func getAPISecret(secretName string) (secretBytes []byte, err error) {
 
 // Handle a serverless request
 func Handle(req []byte) string {
+	// The OpenFaaS gateway sets X-Call-Id on every call
+	requestID := logging.RequestID(os.Getenv("Http_X_Request_Id"), os.Getenv("Http_X_Call_Id"))
+	logger.Set(logging.FieldRequestID, requestID)
+	recorder.SetLogger(logger)
+	reporter.Tag(logging.FieldRequestID, requestID)
+	requestTrace.SetAttribute(logging.FieldRequestID, requestID)
+	recorder.OnPhase(requestTrace.Phase)
+	auditor.Request(requestID, req)
+	notifier.SetRequestID(requestID)
+	response := handle(req)
+	auditor.Record(nil)
+	requestTrace.End()
+	return logging.WithRequestID(response, requestID)
+}
+
+func handle(req []byte) string {
+
+	defer recorder.Finish(metrics.OutcomeSuccess)
 
 	key := os.Getenv("Http_x_api_key")
+	reporter.Tag("keyId", apikey.ID(key))
+	logger.Set(logging.FieldKeyID, apikey.ID(key))
+	requestTrace.SetAttribute(logging.FieldKeyID, apikey.ID(key))
+	auditor.Caller(apikey.ID(key), audit.SourceIP(os.Getenv("Http_X_Forwarded_For"), os.Getenv("Http_X_Real_Ip")))
+	phase := recorder.Phase(metrics.PhaseAuth)
 	err := validateInput(key)
+	phase.Done(err)
 	if err != nil {
-		log.Fatalf("[ERROR] Invalid input: %s", err.Error())
+		fatalf("Invalid input: %s", err.Error())
 	}
 
 	secretBytes, err := getAPISecret("KubeConfig")
 	if err != nil {
-		log.Fatal(err)
+		fatalf("Cannot read secret: %s", err.Error())
 	}
 
 	var kubeConfig types.KubernetesConfig
@@ -46,63 +83,39 @@ func Handle(req []byte) string {
 	var inputData types.ApplyService
 	err = json.Unmarshal(req, &inputData)
 	if err != nil {
-		log.Fatalf("[ERROR] Cannot handle input data: %s", err.Error())
+		fatalf("Cannot handle input data: %s", err.Error())
 	}
 	inputData.Kubeconfig = kubeConfig.Kubeconfig
 
+	reporter.Tag("service", inputData.Service.Metadata.Name)
+	logger.Set(logging.FieldService, inputData.Service.Metadata.Name)
+	requestTrace.SetAttribute(logging.FieldService, inputData.Service.Metadata.Name)
+	auditor.Target(inputData.Service.Metadata.Name, services.Namespace)
 	err = validateData(inputData)
 	if err != nil {
-		log.Fatalf("[ERROR] Invalid data: %s", err.Error())
+		fatalf("Invalid data: %s", err.Error())
 	}
 
 	config, err := clientcmd.RESTConfigFromKubeConfig([]byte(inputData.Kubeconfig))
 	if err != nil {
-		log.Fatalf("[ERROR] Cannot create configuration from provided kubeconfig: %s", err.Error())
+		fatalf("Cannot create configuration from provided kubeconfig: %s", err.Error())
 	}
 
 	client, err := createRESTClient(config)
 	if err != nil {
-		log.Fatalf("[ERROR] Cannot prepare the client: %s", err.Error())
+		fatalf("Cannot prepare the client: %s", err.Error())
 	}
 
-	var result = v1beta1.Service{}
-	var service = &v1beta1.Service{
-		TypeMeta: metav1.TypeMeta{
-			APIVersion: inputData.Service.APIVersion,
-			Kind:       inputData.Service.Kind,
-		},
-		ObjectMeta: metav1.ObjectMeta{
-			Name:   inputData.Service.Metadata.Name,
-			Labels: map[string]string{"app": inputData.Service.Metadata.Labels.App},
-		},
-		Spec: v1beta1.ServiceSpec{
-			Replicas: inputData.Service.Spec.Replicas,
-			Flavor:   inputData.Service.Spec.Flavor,
-			Version:  inputData.Service.Spec.Version,
-			Tags:     inputData.Service.Spec.Tags,
-			Env:      inputData.Service.Spec.Env,
-		},
-	}
-	err = client.Post().Resource("services").Namespace("default").Body(service).Do().Into(&result)
+	result, err := services.Apply(requestTrace.Context(), client, recorder, inputData)
 	if err != nil {
-		if strings.Contains(err.Error(), "already exists") {
-			err = client.Get().Resource("services").Name(inputData.Service.Metadata.Name).Namespace("default").Do().Into(&result)
-			if err != nil {
-				log.Fatalf("[ERROR] Cannot get service: %s", err.Error())
-			}
-			service.ObjectMeta.ResourceVersion = result.ObjectMeta.ResourceVersion
-			err = client.Put().Resource("services").Name(inputData.Service.Metadata.Name).Namespace("default").Body(service).Do().Into(&result)
-			if err != nil {
-				log.Fatalf("[ERROR] Cannot update service: %s", err.Error())
-			}
-		} else {
-			log.Fatalf("[ERROR] Cannot create service: %s", err.Error())
-		}
+		fatalf("Cannot apply service: %s", err.Error())
 	}
+	auditor.ResourceVersion(result.ObjectMeta.ResourceVersion)
+	notifier.Send(notify.Event{Type: notify.ServiceApplied, Service: inputData.Service.Metadata.Name, Namespace: services.Namespace, Object: result})
 
 	serviceJSON, err := json.Marshal(result)
 	if err != nil {
-		log.Fatalf("[ERROR] Cannot marshal output: %s", err.Error())
+		fatalf("Cannot marshal output: %s", err.Error())
 	}
 
 	return string(serviceJSON)
@@ -135,3 +148,14 @@ func validateData(input types.ApplyService) error {
 	// TODO: validation
 	return nil
 }
+
+// fatalf reports, records, audits, traces and logs the failed request
+// before exiting
+func fatalf(format string, v ...interface{}) {
+	reporter.Reportf(format, v...)
+	recorder.Finish(metrics.OutcomeError)
+	auditor.Record(fmt.Errorf(format, v...))
+	requestTrace.Fail(fmt.Errorf(format, v...))
+	requestTrace.End()
+	logger.Fatalf(format, v...)
+}
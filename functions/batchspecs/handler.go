@@ -0,0 +1,431 @@
+package function
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/automium/automium-gateway/pkg/apikey"
+	"github.com/automium/automium-gateway/pkg/audit"
+	"github.com/automium/automium-gateway/pkg/logging"
+	"github.com/automium/automium-gateway/pkg/metrics"
+	"github.com/automium/automium-gateway/pkg/notify"
+	"github.com/automium/automium-gateway/pkg/reporting"
+	"github.com/automium/automium-gateway/pkg/specs"
+	"github.com/automium/automium-gateway/pkg/tracing"
+	types "github.com/automium/types/go/gateway"
+	"github.com/ghodss/yaml"
+	"github.com/satori/go.uuid"
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	gitssh "gopkg.in/src-d/go-git.v4/plumbing/transport/ssh"
+)
+
+const (
+	actionSave   = "save"
+	actionDelete = "delete"
+
+	statusSaved   = "saved"
+	statusDeleted = "deleted"
+	statusInvalid = "invalid"
+	statusSkipped = "skipped"
+)
+
+var recorder = metrics.New("batchspecs")
+var reporter = reporting.New("batchspecs")
+var logger = logging.New("batchspecs").TrackPhase(recorder.CurrentPhase)
+var requestTrace = tracing.FromEnv("batchspecs")
+var auditor = audit.New("batchspecs")
+var notifier = notify.New("batchspecs")
+
+func getAPISecret(secretName string) (secretBytes []byte, err error) {
+	root := "/var/openfaas/secrets/"
+
+	// read from the openfaas secrets folder
+	secretBytes, err = ioutil.ReadFile(root + secretName)
+	return secretBytes, err
+}
+
+//TODO: move to the shared types lib
+type GitSecret struct {
+	GitConfig types.GitConfig `json:"git"`
+	Specs     specs.Layout    `json:"specs"`
+}
+
+//TODO: move to the shared types lib
+type BatchSpecs struct {
+	Operations []SpecOperation `json:"operations"`
+}
+
+//TODO: move to the shared types lib
+type SpecOperation struct {
+	Save   *types.SaveSpec   `json:"save,omitempty"`
+	Delete *types.DeleteSpec `json:"delete,omitempty"`
+}
+
+//TODO: move to the shared types lib
+type BatchResult struct {
+	Status  string            `json:"status"`
+	Commit  string            `json:"commit,omitempty"`
+	Results []OperationResult `json:"results"`
+}
+
+//TODO: move to the shared types lib
+type OperationResult struct {
+	Name   string `json:"name"`
+	Action string `json:"action"`
+	File   string `json:"file,omitempty"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Handle a serverless request
+func Handle(req []byte) string {
+	// The OpenFaaS gateway sets X-Call-Id on every call
+	requestID := logging.RequestID(os.Getenv("Http_X_Request_Id"), os.Getenv("Http_X_Call_Id"))
+	logger.Set(logging.FieldRequestID, requestID)
+	recorder.SetLogger(logger)
+	reporter.Tag(logging.FieldRequestID, requestID)
+	requestTrace.SetAttribute(logging.FieldRequestID, requestID)
+	recorder.OnPhase(requestTrace.Phase)
+	auditor.Request(requestID, req)
+	notifier.SetRequestID(requestID)
+	response := handle(req)
+	auditor.Record(nil)
+	requestTrace.End()
+	return logging.WithRequestID(response, requestID)
+}
+
+func handle(req []byte) string {
+
+	defer recorder.Finish(metrics.OutcomeSuccess)
+
+	key := os.Getenv("Http_X_Api_Key")
+	reporter.Tag("keyId", apikey.ID(key))
+	logger.Set(logging.FieldKeyID, apikey.ID(key))
+	requestTrace.SetAttribute(logging.FieldKeyID, apikey.ID(key))
+	auditor.Caller(apikey.ID(key), audit.SourceIP(os.Getenv("Http_X_Forwarded_For"), os.Getenv("Http_X_Real_Ip")))
+	phase := recorder.Phase(metrics.PhaseAuth)
+	err := validateInput(key)
+	phase.Done(err)
+	if err != nil {
+		fatalf("Invalid input: %s", err.Error())
+	}
+
+	secretBytes, err := getAPISecret("GitConfig")
+	if err != nil {
+		fatalf("Cannot read secret: %s", err.Error())
+	}
+
+	var gitSecret GitSecret
+	err = json.Unmarshal(secretBytes, &gitSecret)
+	gitConfig := gitSecret.GitConfig
+
+	var inputData BatchSpecs
+	err = json.Unmarshal(req, &inputData)
+	if err != nil {
+		fatalf("Cannot parse incoming data: %s", err.Error())
+	}
+
+	results := make([]OperationResult, len(inputData.Operations))
+	var services []string
+	for i, operation := range inputData.Operations {
+		results[i] = newResult(operation, gitSecret.Specs)
+		services = append(services, results[i].Name)
+	}
+
+	reporter.Tag("service", strings.Join(services, ","))
+	logger.Set(logging.FieldService, strings.Join(services, ","))
+	requestTrace.SetAttribute(logging.FieldService, strings.Join(services, ","))
+	auditor.Target(strings.Join(services, ","), "")
+	err = validateData(inputData, results)
+	if err != nil {
+		return rejected(err, results)
+	}
+
+	err = gitSecret.Specs.Validate()
+	if err != nil {
+		fatalf("Invalid spec layout: %s", err.Error())
+	}
+
+	// Generate a working directory
+	workingDirectoryPath := fmt.Sprintf("/home/app/gitrepo_%s", uuid.NewV4().String())
+	err = os.Mkdir(workingDirectoryPath, 0700)
+	if err != nil {
+		fatalf("Cannot prepare temporary working dir: %s", err.Error())
+	}
+
+	// Parse SSH key from input
+	sshKey, err := ssh.ParsePrivateKey([]byte(gitConfig.RepositoryKey))
+	if err != nil {
+		cleanup(workingDirectoryPath)
+		fatalf("Invalid SSH key: %s", err.Error())
+	}
+
+	// Clone the repo once for the whole batch
+	phase = recorder.Phase(metrics.PhaseGitClone)
+	repo, err := git.PlainClone(workingDirectoryPath, false, &git.CloneOptions{
+		Auth: returnSSHConfiguration(gitConfig.RepositoryUsername, sshKey),
+		URL:  gitConfig.RepositoryURL,
+	})
+	phase.Done(err)
+	if err != nil {
+		cleanup(workingDirectoryPath)
+		fatalf("Cannot checkout Git repository: %s", err.Error())
+	}
+
+	// The specs to delete must exist, or nothing is committed
+	err = validateDeletes(workingDirectoryPath, results)
+	if err != nil {
+		cleanup(workingDirectoryPath)
+		return rejected(err, results)
+	}
+
+	// Retrieve the working tree
+	workingTree, err := repo.Worktree()
+	if err != nil {
+		cleanup(workingDirectoryPath)
+		fatalf("Cannot move to working tree: %s", err.Error())
+	}
+
+	err = os.MkdirAll(path.Join(workingDirectoryPath, gitSecret.Specs.Dir()), 0700)
+	if err != nil {
+		cleanup(workingDirectoryPath)
+		fatalf("Cannot prepare spec directory: %s", err.Error())
+	}
+
+	// Stage every operation: a failure leaves the remote repository untouched
+	for i, operation := range inputData.Operations {
+		if operation.Delete != nil {
+			_, err = workingTree.Remove(results[i].File)
+			if err != nil {
+				cleanup(workingDirectoryPath)
+				fatalf("Cannot remove %s for commit: %s", results[i].File, err.Error())
+			}
+			continue
+		}
+
+		spec, err := specYAML(*operation.Save)
+		if err != nil {
+			cleanup(workingDirectoryPath)
+			fatalf("Cannot convert %s spec to yaml: %s", results[i].Name, err.Error())
+		}
+
+		err = ioutil.WriteFile(path.Join(workingDirectoryPath, results[i].File), spec, 0600)
+		if err != nil {
+			cleanup(workingDirectoryPath)
+			fatalf("Cannot update file with %s spec: %s", results[i].Name, err.Error())
+		}
+
+		_, err = workingTree.Add(results[i].File)
+		if err != nil {
+			cleanup(workingDirectoryPath)
+			fatalf("Cannot add %s to commit: %s", results[i].File, err.Error())
+		}
+	}
+
+	// Commit all the changes at once
+	phase = recorder.Phase(metrics.PhaseGitCommit)
+	commit, err := workingTree.Commit(commitMessage(results), &git.CommitOptions{Author: &object.Signature{
+		Name:  "Automium Bot",
+		Email: "automium-bot@automium.io",
+		When:  time.Now(),
+	}})
+	phase.Done(err)
+	if err != nil {
+		cleanup(workingDirectoryPath)
+		fatalf("Cannot commit: %s", err.Error())
+	}
+	auditor.Commit(commit.String())
+
+	// Push the change to the remote repository
+	phase = recorder.Phase(metrics.PhaseGitPush)
+	err = repo.Push(&git.PushOptions{
+		Auth: returnSSHConfiguration(gitConfig.RepositoryUsername, sshKey),
+	})
+	phase.Done(err)
+	if err != nil {
+		cleanup(workingDirectoryPath)
+		fatalf("Cannot push: %s", err.Error())
+	}
+
+	// Cleanup...
+	cleanup(workingDirectoryPath)
+
+	for i := range results {
+		if results[i].Action == actionDelete {
+			results[i].Status = statusDeleted
+			notifier.Send(notify.Event{Type: notify.SpecDeleted, Service: results[i].Name, Commit: commit.String()})
+		} else {
+			results[i].Status = statusSaved
+			notifier.Send(notify.Event{Type: notify.SpecSaved, Service: results[i].Name, Commit: commit.String()})
+		}
+	}
+
+	// ...and we're good to go!
+	output, err := json.Marshal(BatchResult{Status: "OK", Commit: commit.String(), Results: results})
+	if err != nil {
+		fatalf("Cannot marshal output: %s", err.Error())
+	}
+	return string(output)
+}
+
+// newResult describes the operation, before it is validated
+func newResult(operation SpecOperation, layout specs.Layout) OperationResult {
+	result := OperationResult{Status: statusSkipped}
+	switch {
+	case operation.Save != nil:
+		result.Name = operation.Save.ServiceName
+		result.Action = actionSave
+	case operation.Delete != nil:
+		result.Name = operation.Delete.ServiceName
+		result.Action = actionDelete
+	}
+	if result.Name != "" {
+		// an invalid name has no file, validateData rejects it
+		result.File, _ = layout.Path(result.Name)
+	}
+	return result
+}
+
+func validateInput(input string) error {
+	//log.Printf("request with %s key", input)
+	// TODO: validation
+	return nil
+}
+
+// validateData checks every operation before touching the repository,
+// marking the invalid ones in results
+func validateData(input BatchSpecs, results []OperationResult) error {
+	if len(input.Operations) == 0 {
+		return fmt.Errorf("no operations")
+	}
+
+	files := map[string]bool{}
+	for i, operation := range input.Operations {
+		switch {
+		case operation.Save != nil && operation.Delete != nil:
+			invalidate(&results[i], "an operation cannot both save and delete")
+		case operation.Save == nil && operation.Delete == nil:
+			invalidate(&results[i], "missing save or delete")
+		case results[i].Name == "":
+			invalidate(&results[i], "missing name")
+		case results[i].File == "":
+			invalidate(&results[i], specs.ValidateName(results[i].Name).Error())
+		case files[results[i].File]:
+			invalidate(&results[i], fmt.Sprintf("%s is changed by another operation", results[i].File))
+		case operation.Save != nil:
+			_, err := specYAML(*operation.Save)
+			if err != nil {
+				invalidate(&results[i], fmt.Sprintf("invalid spec: %s", err.Error()))
+			}
+		}
+		files[results[i].File] = true
+	}
+	return invalidResults(results)
+}
+
+// validateDeletes checks the specs to delete exist in the cloned repository
+func validateDeletes(workingDirectoryPath string, results []OperationResult) error {
+	for i := range results {
+		if results[i].Action != actionDelete {
+			continue
+		}
+		_, err := os.Stat(path.Join(workingDirectoryPath, results[i].File))
+		if os.IsNotExist(err) {
+			invalidate(&results[i], fmt.Sprintf("%s does not exist", results[i].File))
+		} else if err != nil {
+			invalidate(&results[i], fmt.Sprintf("cannot read %s: %s", results[i].File, err.Error()))
+		}
+	}
+	return invalidResults(results)
+}
+
+func invalidate(result *OperationResult, message string) {
+	result.Status = statusInvalid
+	result.Error = message
+}
+
+func invalidResults(results []OperationResult) error {
+	invalid := 0
+	for _, result := range results {
+		if result.Status == statusInvalid {
+			invalid++
+		}
+	}
+	if invalid > 0 {
+		return fmt.Errorf("%d of %d operations are invalid", invalid, len(results))
+	}
+	return nil
+}
+
+// rejected records, audits, traces and logs a batch not committed because of
+// invalid operations, and answers with the results. The operations are the
+// client's error, so it is not reported to the error tracker.
+func rejected(err error, results []OperationResult) string {
+	recorder.Finish(metrics.OutcomeClientError)
+	auditor.Record(fmt.Errorf("Invalid data: %s", err.Error()))
+	requestTrace.Fail(fmt.Errorf("Invalid data: %s", err.Error()))
+	logger.Errorf("Invalid data: %s", err.Error())
+
+	output, err := json.Marshal(BatchResult{Status: "FAILED", Results: results})
+	if err != nil {
+		fatalf("Cannot marshal output: %s", err.Error())
+	}
+	return string(output)
+}
+
+func specYAML(input types.SaveSpec) ([]byte, error) {
+	service, err := json.Marshal(input.Service)
+	if err != nil {
+		return nil, err
+	}
+	return yaml.JSONToYAML([]byte(service))
+}
+
+func commitMessage(results []OperationResult) string {
+	var saved, removed []string
+	for _, result := range results {
+		if result.Action == actionDelete {
+			removed = append(removed, result.Name)
+		} else {
+			saved = append(saved, result.Name)
+		}
+	}
+
+	message := fmt.Sprintf("[AUTOMIUM] Update %d specs", len(results))
+	if len(saved) > 0 {
+		message += fmt.Sprintf("\n\nUpdate: %s", strings.Join(saved, ", "))
+	}
+	if len(removed) > 0 {
+		message += fmt.Sprintf("\n\nRemove: %s", strings.Join(removed, ", "))
+	}
+	return message
+}
+
+func cleanup(path string) {
+	os.RemoveAll(path)
+}
+
+func returnSSHConfiguration(user string, signer ssh.Signer) *gitssh.PublicKeys {
+	obj := &gitssh.PublicKeys{User: user, Signer: signer}
+	// TODO: find a way to check SSH host keys
+	obj.HostKeyCallback = ssh.InsecureIgnoreHostKey()
+	return obj
+}
+
+// fatalf reports, records, audits, traces and logs the failed request
+// before exiting
+func fatalf(format string, v ...interface{}) {
+	reporter.Reportf(format, v...)
+	recorder.Finish(metrics.OutcomeError)
+	auditor.Record(fmt.Errorf(format, v...))
+	requestTrace.Fail(fmt.Errorf(format, v...))
+	requestTrace.End()
+	logger.Fatalf(format, v...)
+}
@@ -0,0 +1,145 @@
+package function
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+
+	"github.com/automium/automium-gateway/pkg/specs"
+)
+
+func TestValidateData(t *testing.T) {
+	tests := []struct {
+		name      string
+		request   string
+		statuses  []string
+		shouldErr bool
+	}{
+		{
+			"valid",
+			`{"operations": [{"save": {"name": "web"}}, {"delete": {"name": "db"}}]}`,
+			[]string{statusSkipped, statusSkipped},
+			false,
+		},
+		{
+			"no operations",
+			`{"operations": []}`,
+			[]string{},
+			true,
+		},
+		{
+			"both save and delete",
+			`{"operations": [{"save": {"name": "web"}, "delete": {"name": "web"}}, {"delete": {"name": "db"}}]}`,
+			[]string{statusInvalid, statusSkipped},
+			true,
+		},
+		{
+			"neither save nor delete",
+			`{"operations": [{}, {"save": {"name": "web"}}]}`,
+			[]string{statusInvalid, statusSkipped},
+			true,
+		},
+		{
+			"missing name",
+			`{"operations": [{"delete": {}}]}`,
+			[]string{statusInvalid},
+			true,
+		},
+		{
+			"invalid name",
+			`{"operations": [{"save": {"name": "../web"}}, {"delete": {"name": "db"}}]}`,
+			[]string{statusInvalid, statusSkipped},
+			true,
+		},
+		{
+			"duplicate file",
+			`{"operations": [{"save": {"name": "web"}}, {"delete": {"name": "WEB"}}, {"save": {"name": "db"}}]}`,
+			[]string{statusSkipped, statusInvalid, statusSkipped},
+			true,
+		},
+	}
+
+	for _, test := range tests {
+		var input BatchSpecs
+		err := json.Unmarshal([]byte(test.request), &input)
+		if err != nil {
+			t.Fatalf("%s: invalid request: %s", test.name, err.Error())
+		}
+
+		results := make([]OperationResult, len(input.Operations))
+		for i, operation := range input.Operations {
+			results[i] = newResult(operation, specs.Layout{Root: "services"})
+		}
+		err = validateData(input, results)
+
+		if (err != nil) != test.shouldErr {
+			t.Errorf("%s: expected error %t, got %v", test.name, test.shouldErr, err)
+		}
+		statuses := []string{}
+		for _, result := range results {
+			statuses = append(statuses, result.Status)
+		}
+		if !reflect.DeepEqual(statuses, test.statuses) {
+			t.Errorf("%s: expected statuses %v, got %v", test.name, test.statuses, statuses)
+		}
+	}
+}
+
+func TestValidateDeletes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "batchspecs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, file := range []string{"web.yaml", "notadir"} {
+		err = ioutil.WriteFile(path.Join(dir, file), []byte("spec"), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name      string
+		results   []OperationResult
+		statuses  []string
+		shouldErr bool
+	}{
+		{
+			"existing spec",
+			[]OperationResult{{Action: actionDelete, File: "web.yaml", Status: statusSkipped}, {Action: actionSave, File: "db.yaml", Status: statusSkipped}},
+			[]string{statusSkipped, statusSkipped},
+			false,
+		},
+		{
+			"missing spec",
+			[]OperationResult{{Action: actionDelete, File: "db.yaml", Status: statusSkipped}},
+			[]string{statusInvalid},
+			true,
+		},
+		{
+			"unreadable spec",
+			[]OperationResult{{Action: actionDelete, File: "notadir/web.yaml", Status: statusSkipped}},
+			[]string{statusInvalid},
+			true,
+		},
+	}
+
+	for _, test := range tests {
+		err := validateDeletes(dir, test.results)
+
+		if (err != nil) != test.shouldErr {
+			t.Errorf("%s: expected error %t, got %v", test.name, test.shouldErr, err)
+		}
+		var statuses []string
+		for _, result := range test.results {
+			statuses = append(statuses, result.Status)
+		}
+		if !reflect.DeepEqual(statuses, test.statuses) {
+			t.Errorf("%s: expected statuses %v, got %v", test.name, test.statuses, statuses)
+		}
+	}
+}
@@ -0,0 +1,422 @@
+package function
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/automium/automium-gateway/pkg/apikey"
+	"github.com/automium/automium-gateway/pkg/audit"
+	"github.com/automium/automium-gateway/pkg/logging"
+	"github.com/automium/automium-gateway/pkg/metrics"
+	"github.com/automium/automium-gateway/pkg/notify"
+	"github.com/automium/automium-gateway/pkg/reporting"
+	"github.com/automium/automium-gateway/pkg/services"
+	"github.com/automium/automium-gateway/pkg/tracing"
+	types "github.com/automium/types/go/gateway"
+	v1beta1 "github.com/automium/types/go/v1beta1"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+const (
+	statusApplied = "applied"
+	statusFailed  = "failed"
+	statusSkipped = "skipped"
+
+	errNoTimeLeft = "no time left to apply the service"
+
+	defaultWorkers = 4
+	maxWorkers     = 16
+	defaultTimeout = 30 * time.Second
+	// deadlineMargin is left before exec_timeout to notify the services
+	// applied and answer
+	deadlineMargin = 15 * time.Second
+)
+
+var recorder = metrics.New("bulkapply")
+var reporter = reporting.New("bulkapply")
+var logger = logging.New("bulkapply").TrackPhase(recorder.CurrentPhase)
+var requestTrace = tracing.FromEnv("bulkapply")
+var auditor = audit.New("bulkapply")
+var notifier = notify.New("bulkapply")
+
+func getAPISecret(secretName string) (secretBytes []byte, err error) {
+	root := "/var/openfaas/secrets/"
+
+	// read from the openfaas secrets folder
+	secretBytes, err = ioutil.ReadFile(root + secretName)
+	return secretBytes, err
+}
+
+//TODO: move to the shared types lib
+type BulkApply struct {
+	Services []BulkService `json:"services"`
+	// Workers applying the services concurrently
+	Workers int `json:"workers"`
+	// Timeout of each service, e.g. "30s"
+	Timeout string `json:"timeout"`
+}
+
+//TODO: move to the shared types lib
+type BulkService struct {
+	types.ApplyService
+	// DependsOn lists the services applied before this one
+	DependsOn []string `json:"dependsOn"`
+}
+
+//TODO: move to the shared types lib
+type BulkResult struct {
+	Status   string          `json:"status"`
+	Services []ServiceResult `json:"services"`
+}
+
+//TODO: move to the shared types lib
+type ServiceResult struct {
+	Name            string  `json:"name"`
+	Status          string  `json:"status"`
+	ResourceVersion string  `json:"resourceVersion,omitempty"`
+	Error           string  `json:"error,omitempty"`
+	Duration        float64 `json:"duration"`
+}
+
+// Handle a serverless request
+func Handle(req []byte) string {
+	// The OpenFaaS gateway sets X-Call-Id on every call
+	requestID := logging.RequestID(os.Getenv("Http_X_Request_Id"), os.Getenv("Http_X_Call_Id"))
+	logger.Set(logging.FieldRequestID, requestID)
+	recorder.SetLogger(logger)
+	reporter.Tag(logging.FieldRequestID, requestID)
+	requestTrace.SetAttribute(logging.FieldRequestID, requestID)
+	recorder.OnPhase(requestTrace.Phase)
+	auditor.Request(requestID, req)
+	notifier.SetRequestID(requestID)
+	response := handle(req)
+	auditor.Record(nil)
+	requestTrace.End()
+	return logging.WithRequestID(response, requestID)
+}
+
+func handle(req []byte) string {
+
+	defer recorder.Finish(metrics.OutcomeSuccess)
+
+	key := os.Getenv("Http_X_Api_Key")
+	reporter.Tag("keyId", apikey.ID(key))
+	logger.Set(logging.FieldKeyID, apikey.ID(key))
+	requestTrace.SetAttribute(logging.FieldKeyID, apikey.ID(key))
+	auditor.Caller(apikey.ID(key), audit.SourceIP(os.Getenv("Http_X_Forwarded_For"), os.Getenv("Http_X_Real_Ip")))
+	phase := recorder.Phase(metrics.PhaseAuth)
+	err := validateInput(key)
+	phase.Done(err)
+	if err != nil {
+		fatalf("Invalid input: %s", err.Error())
+	}
+
+	secretBytes, err := getAPISecret("KubeConfig")
+	if err != nil {
+		fatalf("Cannot read secret: %s", err.Error())
+	}
+
+	var kubeConfig types.KubernetesConfig
+	err = json.Unmarshal(secretBytes, &kubeConfig)
+
+	var inputData BulkApply
+	err = json.Unmarshal(req, &inputData)
+	if err != nil {
+		fatalf("Cannot handle input data: %s", err.Error())
+	}
+
+	var names []string
+	for _, service := range inputData.Services {
+		names = append(names, service.Service.Metadata.Name)
+	}
+
+	reporter.Tag("service", strings.Join(names, ","))
+	logger.Set(logging.FieldService, strings.Join(names, ","))
+	requestTrace.SetAttribute(logging.FieldService, strings.Join(names, ","))
+	auditor.Target(strings.Join(names, ","), services.Namespace)
+	err = validateData(inputData)
+	if err != nil {
+		fatalf("Invalid data: %s", err.Error())
+	}
+
+	workers, timeout, err := limits(inputData)
+	if err != nil {
+		fatalf("Invalid data: %s", err.Error())
+	}
+
+	// The services not applied before exec_timeout are skipped, so the
+	// function still answers
+	ctx := requestTrace.Context()
+	total, err := execTimeout()
+	if err != nil {
+		fatalf("Invalid exec_timeout: %s", err.Error())
+	}
+	if total > deadlineMargin {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, total-deadlineMargin)
+		defer cancel()
+	}
+
+	config, err := clientcmd.RESTConfigFromKubeConfig([]byte(kubeConfig.Kubeconfig))
+	if err != nil {
+		fatalf("Cannot create configuration from provided kubeconfig: %s", err.Error())
+	}
+
+	client, err := createRESTClient(config)
+	if err != nil {
+		fatalf("Cannot prepare the client: %s", err.Error())
+	}
+
+	apply := func(ctx context.Context, input types.ApplyService) (v1beta1.Service, error) {
+		return services.Apply(ctx, client, recorder, input)
+	}
+	results := applyAll(ctx, apply, inputData.Services, workers, timeout)
+
+	status := "OK"
+	for _, result := range results {
+		if result.Status != statusApplied {
+			status = "PARTIAL"
+		}
+	}
+	if status != "OK" {
+		auditor.Record(fmt.Errorf("Cannot apply every service"))
+	}
+
+	output, err := json.Marshal(BulkResult{Status: status, Services: results})
+	if err != nil {
+		fatalf("Cannot marshal output: %s", err.Error())
+	}
+
+	return string(output)
+}
+
+// applyFunc applies a service, services.Apply outside of the tests
+type applyFunc func(ctx context.Context, input types.ApplyService) (v1beta1.Service, error)
+
+// applyAll applies the services with a pool of workers, until ctx is done.
+// A service waits for its dependencies, and is skipped when one of them is
+// not applied.
+func applyAll(ctx context.Context, apply applyFunc, bulk []BulkService, workers int, timeout time.Duration) []ServiceResult {
+	results := make([]ServiceResult, len(bulk))
+	done := make([]chan struct{}, len(bulk))
+	index := map[string]int{}
+	for i, service := range bulk {
+		done[i] = make(chan struct{})
+		index[service.Service.Metadata.Name] = i
+	}
+
+	slots := make(chan struct{}, workers)
+	var wg sync.WaitGroup
+	for i := range bulk {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer close(done[i])
+
+			results[i].Name = bulk[i].Service.Metadata.Name
+			// Waiting for the dependencies does not take a worker
+			for _, dependency := range bulk[i].DependsOn {
+				<-done[index[dependency]]
+				if results[index[dependency]].Status != statusApplied {
+					results[i].Status = statusSkipped
+					results[i].Error = fmt.Sprintf("dependency %s not applied", dependency)
+					return
+				}
+			}
+
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				results[i].Status = statusSkipped
+				results[i].Error = errNoTimeLeft
+				return
+			}
+			// A slot freed at the deadline must not start another service
+			if ctx.Err() != nil {
+				<-slots
+				results[i].Status = statusSkipped
+				results[i].Error = errNoTimeLeft
+				return
+			}
+
+			start := time.Now()
+			serviceCtx, cancel := context.WithTimeout(ctx, timeout)
+			result, err := apply(serviceCtx, bulk[i].ApplyService)
+			cancel()
+			// The worker is free for the next service while notifying
+			<-slots
+			results[i].Duration = time.Since(start).Seconds()
+			if err != nil {
+				results[i].Status = statusFailed
+				results[i].Error = err.Error()
+				logger.Errorf("Cannot apply service %s: %s", results[i].Name, err.Error())
+				return
+			}
+
+			results[i].Status = statusApplied
+			results[i].ResourceVersion = result.ObjectMeta.ResourceVersion
+			notifier.Send(notify.Event{Type: notify.ServiceApplied, Service: results[i].Name, Namespace: services.Namespace, Object: result})
+		}(i)
+	}
+	wg.Wait()
+
+	return results
+}
+
+// limits returns the workers and the timeout of each service, from the
+// request or else from the bulk_workers and bulk_timeout environment
+// variables. There are at most maxWorkers workers.
+func limits(input BulkApply) (int, time.Duration, error) {
+	workers := defaultWorkers
+	if value := os.Getenv("bulk_workers"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 {
+			return 0, 0, fmt.Errorf("invalid bulk_workers %s", value)
+		}
+		workers = parsed
+	}
+	if input.Workers < 0 {
+		return 0, 0, fmt.Errorf("workers must be positive")
+	}
+	if input.Workers > 0 {
+		workers = input.Workers
+	}
+	if workers > maxWorkers {
+		return 0, 0, fmt.Errorf("workers must be at most %d", maxWorkers)
+	}
+
+	timeout := defaultTimeout
+	value := os.Getenv("bulk_timeout")
+	if input.Timeout != "" {
+		value = input.Timeout
+	}
+	if value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 {
+			return 0, 0, fmt.Errorf("invalid timeout %s", value)
+		}
+		timeout = parsed
+	}
+
+	return workers, timeout, nil
+}
+
+// execTimeout returns the exec_timeout of the watchdog, in seconds or as a
+// duration, or zero when the function has none
+func execTimeout() (time.Duration, error) {
+	value := os.Getenv("exec_timeout")
+	if value == "" {
+		return 0, nil
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second, nil
+	}
+	return time.ParseDuration(value)
+}
+
+func createRESTClient(config *rest.Config) (*rest.RESTClient, error) {
+	v1beta1.AddToScheme(scheme.Scheme)
+
+	crdConfig := *config
+	crdConfig.ContentConfig.GroupVersion = &schema.GroupVersion{Group: v1beta1.GroupName, Version: v1beta1.GroupVersion}
+	crdConfig.APIPath = "/apis"
+	crdConfig.NegotiatedSerializer = serializer.DirectCodecFactory{CodecFactory: scheme.Codecs}
+	crdConfig.UserAgent = rest.DefaultKubernetesUserAgent()
+
+	rc, err := rest.UnversionedRESTClientFor(&crdConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	return rc, nil
+}
+
+func validateInput(input string) error {
+	//log.Printf("request with %s key", input)
+	// TODO: validation
+	return nil
+}
+
+// validateData checks the names and the dependencies of the services: an
+// unknown dependency or a cycle would never be applied
+func validateData(input BulkApply) error {
+	if len(input.Services) == 0 {
+		return fmt.Errorf("no services")
+	}
+
+	dependencies := map[string][]string{}
+	for _, service := range input.Services {
+		name := service.Service.Metadata.Name
+		if name == "" {
+			return fmt.Errorf("missing service name")
+		}
+		if _, ok := dependencies[name]; ok {
+			return fmt.Errorf("service %s is listed twice", name)
+		}
+		dependencies[name] = service.DependsOn
+	}
+
+	for name, dependsOn := range dependencies {
+		for _, dependency := range dependsOn {
+			if _, ok := dependencies[dependency]; !ok {
+				return fmt.Errorf("service %s depends on unknown service %s", name, dependency)
+			}
+		}
+	}
+
+	// Depth-first search of a cycle
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := map[string]int{}
+	var visit func(name string) error
+	visit = func(name string) error {
+		switch state[name] {
+		case visiting:
+			return fmt.Errorf("dependency cycle through service %s", name)
+		case visited:
+			return nil
+		}
+		state[name] = visiting
+		for _, dependency := range dependencies[name] {
+			err := visit(dependency)
+			if err != nil {
+				return err
+			}
+		}
+		state[name] = visited
+		return nil
+	}
+	for _, service := range input.Services {
+		err := visit(service.Service.Metadata.Name)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// fatalf reports, records, audits, traces and logs the failed request
+// before exiting
+func fatalf(format string, v ...interface{}) {
+	reporter.Reportf(format, v...)
+	recorder.Finish(metrics.OutcomeError)
+	auditor.Record(fmt.Errorf(format, v...))
+	requestTrace.Fail(fmt.Errorf(format, v...))
+	requestTrace.End()
+	logger.Fatalf(format, v...)
+}
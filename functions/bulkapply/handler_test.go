@@ -0,0 +1,247 @@
+package function
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	types "github.com/automium/types/go/gateway"
+	v1beta1 "github.com/automium/types/go/v1beta1"
+)
+
+func bulkService(name string, dependsOn ...string) BulkService {
+	var service BulkService
+	service.Service.Metadata.Name = name
+	service.DependsOn = dependsOn
+	return service
+}
+
+func TestValidateData(t *testing.T) {
+	tests := []struct {
+		name      string
+		services  []BulkService
+		shouldErr bool
+	}{
+		{"no services", nil, true},
+		{"independent services", []BulkService{bulkService("db"), bulkService("cache")}, false},
+		{"dependencies", []BulkService{bulkService("web", "db", "cache"), bulkService("db"), bulkService("cache", "db")}, false},
+		{"missing name", []BulkService{bulkService("db"), bulkService("")}, true},
+		{"listed twice", []BulkService{bulkService("db"), bulkService("db")}, true},
+		{"unknown dependency", []BulkService{bulkService("web", "db")}, true},
+		{"self dependency", []BulkService{bulkService("db", "db")}, true},
+		{"cycle", []BulkService{bulkService("web", "api"), bulkService("api", "db"), bulkService("db", "web")}, true},
+		{"cycle after a valid chain", []BulkService{bulkService("web", "db"), bulkService("db"), bulkService("a", "b"), bulkService("b", "a")}, true},
+	}
+
+	for _, test := range tests {
+		err := validateData(BulkApply{Services: test.services})
+		if (err != nil) != test.shouldErr {
+			t.Errorf("%s: expected error %t, got %v", test.name, test.shouldErr, err)
+		}
+	}
+}
+
+// fakeCluster applies the services of applyAll, recording the order and
+// the services applied at the same time
+type fakeCluster struct {
+	failing map[string]bool
+	// block makes every apply wait for the deadline
+	block bool
+
+	mu         sync.Mutex
+	applied    []string
+	running    int
+	maxRunning int
+}
+
+func (c *fakeCluster) apply(ctx context.Context, input types.ApplyService) (v1beta1.Service, error) {
+	name := input.Service.Metadata.Name
+	c.mu.Lock()
+	c.running++
+	if c.running > c.maxRunning {
+		c.maxRunning = c.running
+	}
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		c.running--
+		c.mu.Unlock()
+	}()
+
+	if c.block {
+		<-ctx.Done()
+		return v1beta1.Service{}, ctx.Err()
+	}
+	time.Sleep(5 * time.Millisecond)
+	if c.failing[name] {
+		return v1beta1.Service{}, fmt.Errorf("cannot create service")
+	}
+
+	c.mu.Lock()
+	c.applied = append(c.applied, name)
+	c.mu.Unlock()
+	return v1beta1.Service{}, nil
+}
+
+func TestApplyAll(t *testing.T) {
+	tests := []struct {
+		name     string
+		services []BulkService
+		workers  int
+		cluster  *fakeCluster
+		// deadline of the bulk apply, none when zero
+		deadline time.Duration
+		statuses map[string]string
+	}{
+		{
+			"dependencies first",
+			[]BulkService{bulkService("web", "api", "cache"), bulkService("api", "db"), bulkService("cache", "db"), bulkService("db")},
+			4,
+			&fakeCluster{},
+			0,
+			map[string]string{"web": statusApplied, "api": statusApplied, "cache": statusApplied, "db": statusApplied},
+		},
+		{
+			"dependents of a failed service",
+			[]BulkService{bulkService("web", "api"), bulkService("api", "db"), bulkService("db"), bulkService("cache")},
+			2,
+			&fakeCluster{failing: map[string]bool{"db": true}},
+			0,
+			map[string]string{"web": statusSkipped, "api": statusSkipped, "db": statusFailed, "cache": statusApplied},
+		},
+		{
+			"deadline already passed",
+			[]BulkService{bulkService("web", "db"), bulkService("db"), bulkService("cache")},
+			4,
+			&fakeCluster{},
+			-time.Second,
+			map[string]string{"web": statusSkipped, "db": statusSkipped, "cache": statusSkipped},
+		},
+		{
+			"deadline while applying",
+			[]BulkService{bulkService("web", "db"), bulkService("db")},
+			4,
+			&fakeCluster{block: true},
+			20 * time.Millisecond,
+			map[string]string{"web": statusSkipped, "db": statusFailed},
+		},
+		{
+			"worker bound",
+			[]BulkService{bulkService("a"), bulkService("b"), bulkService("c"), bulkService("d"), bulkService("e"), bulkService("f")},
+			2,
+			&fakeCluster{},
+			0,
+			map[string]string{"a": statusApplied, "b": statusApplied, "c": statusApplied, "d": statusApplied, "e": statusApplied, "f": statusApplied},
+		},
+	}
+
+	for _, test := range tests {
+		ctx := context.Background()
+		if test.deadline != 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, test.deadline)
+			defer cancel()
+		}
+
+		results := applyAll(ctx, test.cluster.apply, test.services, test.workers, time.Minute)
+
+		if len(results) != len(test.services) {
+			t.Fatalf("%s: expected %d results, got %d", test.name, len(test.services), len(results))
+		}
+		for i, result := range results {
+			name := test.services[i].Service.Metadata.Name
+			if result.Name != name {
+				t.Errorf("%s: expected result %d to be %s, got %s", test.name, i, name, result.Name)
+			}
+			if result.Status != test.statuses[name] {
+				t.Errorf("%s: expected %s to be %s, got %s (%s)", test.name, name, test.statuses[name], result.Status, result.Error)
+			}
+		}
+
+		order := map[string]int{}
+		for i, name := range test.cluster.applied {
+			order[name] = i
+		}
+		for _, service := range test.services {
+			name := service.Service.Metadata.Name
+			if _, ok := order[name]; !ok {
+				continue
+			}
+			for _, dependency := range service.DependsOn {
+				if dependencyOrder, ok := order[dependency]; !ok || dependencyOrder > order[name] {
+					t.Errorf("%s: expected %s to be applied before %s, got %v", test.name, dependency, name, test.cluster.applied)
+				}
+			}
+		}
+
+		if test.cluster.maxRunning > test.workers {
+			t.Errorf("%s: expected at most %d services applied at the same time, got %d", test.name, test.workers, test.cluster.maxRunning)
+		}
+	}
+}
+
+func TestLimits(t *testing.T) {
+	tests := []struct {
+		name      string
+		env       map[string]string
+		input     BulkApply
+		workers   int
+		timeout   time.Duration
+		shouldErr bool
+	}{
+		{"defaults", nil, BulkApply{}, defaultWorkers, defaultTimeout, false},
+		{"environment", map[string]string{"bulk_workers": "8", "bulk_timeout": "1m"}, BulkApply{}, 8, time.Minute, false},
+		{"request", map[string]string{"bulk_workers": "8", "bulk_timeout": "1m"}, BulkApply{Workers: 2, Timeout: "10s"}, 2, 10 * time.Second, false},
+		{"too many workers", nil, BulkApply{Workers: maxWorkers + 1}, 0, 0, true},
+		{"negative workers", map[string]string{"bulk_workers": "8"}, BulkApply{Workers: -1}, 0, 0, true},
+		{"invalid workers", map[string]string{"bulk_workers": "none"}, BulkApply{}, 0, 0, true},
+		{"invalid timeout", nil, BulkApply{Timeout: "-1s"}, 0, 0, true},
+	}
+
+	for _, test := range tests {
+		os.Unsetenv("bulk_workers")
+		os.Unsetenv("bulk_timeout")
+		for name, value := range test.env {
+			os.Setenv(name, value)
+		}
+
+		workers, timeout, err := limits(test.input)
+		if (err != nil) != test.shouldErr {
+			t.Errorf("%s: expected error %t, got %v", test.name, test.shouldErr, err)
+		}
+		if workers != test.workers || timeout != test.timeout {
+			t.Errorf("%s: expected %d workers and %s, got %d and %s", test.name, test.workers, test.timeout, workers, timeout)
+		}
+	}
+	os.Unsetenv("bulk_workers")
+	os.Unsetenv("bulk_timeout")
+}
+
+func TestExecTimeout(t *testing.T) {
+	tests := []struct {
+		value     string
+		expected  time.Duration
+		shouldErr bool
+	}{
+		{"", 0, false},
+		{"300", 300 * time.Second, false},
+		{"300s", 300 * time.Second, false},
+		{"5m", 5 * time.Minute, false},
+		{"soon", 0, true},
+	}
+
+	for _, test := range tests {
+		os.Setenv("exec_timeout", test.value)
+		actual, err := execTimeout()
+		if (err != nil) != test.shouldErr {
+			t.Errorf("%q: expected error %t, got %v", test.value, test.shouldErr, err)
+		}
+		if actual != test.expected {
+			t.Errorf("%q: expected %s, got %s", test.value, test.expected, actual)
+		}
+	}
+	os.Unsetenv("exec_timeout")
+}
@@ -0,0 +1,269 @@
+package function
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/automium/automium-gateway/pkg/apikey"
+	"github.com/automium/automium-gateway/pkg/audit"
+	"github.com/automium/automium-gateway/pkg/logging"
+	"github.com/automium/automium-gateway/pkg/metrics"
+	"github.com/automium/automium-gateway/pkg/reporting"
+	"github.com/automium/automium-gateway/pkg/tracing"
+	types "github.com/automium/types/go/gateway"
+	v1beta1 "github.com/automium/types/go/v1beta1"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+const (
+	defaultNamespace   = "default"
+	defaultWaitTimeout = 60
+	waitPollInterval   = 2 * time.Second
+)
+
+//TODO: move to the shared types lib
+type DeleteService struct {
+	ServiceName        string                     `json:"name"`
+	Namespace          string                     `json:"namespace"`
+	PropagationPolicy  string                     `json:"propagationPolicy"`
+	GracePeriodSeconds *int64                     `json:"gracePeriodSeconds"`
+	Preconditions      DeleteServicePreconditions `json:"preconditions"`
+	Wait               bool                       `json:"wait"`
+	WaitTimeoutSeconds int                        `json:"waitTimeoutSeconds"`
+	Kubeconfig         string                     `json:"-"`
+}
+
+//TODO: move to the shared types lib
+type DeleteServicePreconditions struct {
+	UID             string `json:"uid"`
+	ResourceVersion string `json:"resourceVersion"`
+}
+
+var recorder = metrics.New("deleteservice")
+var reporter = reporting.New("deleteservice")
+var logger = logging.New("deleteservice").TrackPhase(recorder.CurrentPhase)
+var requestTrace = tracing.FromEnv("deleteservice")
+var auditor = audit.New("deleteservice")
+
+func getAPISecret(secretName string) (secretBytes []byte, err error) {
+	root := "/var/openfaas/secrets/"
+
+	// read from the openfaas secrets folder
+	secretBytes, err = ioutil.ReadFile(root + secretName)
+	return secretBytes, err
+}
+
+// Handle a serverless request
+func Handle(req []byte) string {
+	// The OpenFaaS gateway sets X-Call-Id on every call
+	requestID := logging.RequestID(os.Getenv("Http_X_Request_Id"), os.Getenv("Http_X_Call_Id"))
+	logger.Set(logging.FieldRequestID, requestID)
+	recorder.SetLogger(logger)
+	reporter.Tag(logging.FieldRequestID, requestID)
+	requestTrace.SetAttribute(logging.FieldRequestID, requestID)
+	recorder.OnPhase(requestTrace.Phase)
+	auditor.Request(requestID, req)
+	response := handle(req)
+	auditor.Record(nil)
+	requestTrace.End()
+	return logging.WithRequestID(response, requestID)
+}
+
+func handle(req []byte) string {
+
+	defer recorder.Finish(metrics.OutcomeSuccess)
+
+	key := os.Getenv("Http_X_Api_Key")
+	reporter.Tag("keyId", apikey.ID(key))
+	logger.Set(logging.FieldKeyID, apikey.ID(key))
+	requestTrace.SetAttribute(logging.FieldKeyID, apikey.ID(key))
+	auditor.Caller(apikey.ID(key), audit.SourceIP(os.Getenv("Http_X_Forwarded_For"), os.Getenv("Http_X_Real_Ip")))
+	phase := recorder.Phase(metrics.PhaseAuth)
+	err := validateInput(key)
+	phase.Done(err)
+	if err != nil {
+		fatalf("Invalid input: %s", err.Error())
+	}
+
+	secretBytes, err := getAPISecret("KubeConfig")
+	if err != nil {
+		fatalf("Cannot read secret: %s", err.Error())
+	}
+
+	var kubeConfig types.KubernetesConfig
+	err = json.Unmarshal(secretBytes, &kubeConfig)
+
+	var inputData DeleteService
+	err = json.Unmarshal(req, &inputData)
+	if err != nil {
+		fatalf("Cannot handle input data: %s", err.Error())
+	}
+	inputData.Kubeconfig = kubeConfig.Kubeconfig
+	if inputData.Namespace == "" {
+		inputData.Namespace = defaultNamespace
+	}
+	if inputData.WaitTimeoutSeconds <= 0 {
+		inputData.WaitTimeoutSeconds = defaultWaitTimeout
+	}
+
+	reporter.Tag("service", inputData.ServiceName)
+	logger.Set(logging.FieldService, inputData.ServiceName)
+	requestTrace.SetAttribute(logging.FieldService, inputData.ServiceName)
+	auditor.Target(inputData.ServiceName, inputData.Namespace)
+	err = validateData(inputData)
+	if err != nil {
+		fatalf("Invalid data: %s", err.Error())
+	}
+
+	config, err := clientcmd.RESTConfigFromKubeConfig([]byte(inputData.Kubeconfig))
+	if err != nil {
+		fatalf("Cannot create configuration from provided kubeconfig: %s", err.Error())
+	}
+
+	client, err := createRESTClient(config)
+	if err != nil {
+		fatalf("Cannot prepare the client: %s", err.Error())
+	}
+
+	// Retrieve the service first, so the caller gets a clear answer when it
+	// does not exist and the preconditions can be checked
+	var current = v1beta1.Service{}
+	phase = recorder.KubernetesPhase("GET", "services", inputData.ServiceName)
+	err = client.Get().Resource("services").Name(inputData.ServiceName).Namespace(inputData.Namespace).Do().Into(&current)
+	phase.Done(err)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return fmt.Sprintf("{ \"status\": \"NotFound\"}")
+		}
+		fatalf("Cannot get service: %s", err.Error())
+	}
+	auditor.ResourceVersion(current.ObjectMeta.ResourceVersion)
+
+	// The delete options of this Kubernetes version only have a UID
+	// precondition, so the resource version is checked on the service we
+	// just read
+	resourceVersion := inputData.Preconditions.ResourceVersion
+	if resourceVersion != "" && resourceVersion != current.ObjectMeta.ResourceVersion {
+		fatalf("Service precondition failed: resource version is %s, not %s", current.ObjectMeta.ResourceVersion, resourceVersion)
+	}
+
+	deleteOptions := buildDeleteOptions(inputData, current)
+	phase = recorder.KubernetesPhase("DELETE", "services", inputData.ServiceName)
+	err = client.Delete().Resource("services").Name(inputData.ServiceName).Namespace(inputData.Namespace).Body(deleteOptions).Do().Error()
+	phase.Done(err)
+	if err != nil {
+		if errors.IsConflict(err) {
+			fatalf("Service precondition failed: %s", err.Error())
+		}
+		fatalf("Cannot delete service: %s", err.Error())
+	}
+
+	if !inputData.Wait {
+		return fmt.Sprintf("{ \"status\": \"Deleting\"}")
+	}
+
+	// Poll until the service disappears (finalizers and foreground deletion
+	// can keep it around for a while)
+	phase = recorder.KubernetesPhase("WAIT", "services", inputData.ServiceName)
+	err = wait.PollImmediate(waitPollInterval, time.Duration(inputData.WaitTimeoutSeconds)*time.Second, func() (bool, error) {
+		err := client.Get().Resource("services").Name(inputData.ServiceName).Namespace(inputData.Namespace).Do().Error()
+		if errors.IsNotFound(err) {
+			return true, nil
+		}
+		return false, err
+	})
+	phase.Done(err)
+	if err != nil {
+		fatalf("Service %s still present: %s", inputData.ServiceName, err.Error())
+	}
+
+	return fmt.Sprintf("{ \"status\": \"Deleted\"}")
+}
+
+func buildDeleteOptions(input DeleteService, current v1beta1.Service) *metav1.DeleteOptions {
+	options := &metav1.DeleteOptions{
+		GracePeriodSeconds: input.GracePeriodSeconds,
+	}
+
+	if input.PropagationPolicy != "" {
+		policy := metav1.DeletionPropagation(input.PropagationPolicy)
+		options.PropagationPolicy = &policy
+	}
+
+	// When only the resource version is given, pin the deletion to the UID we
+	// just checked so a recreated service with the same name is never removed
+	if input.Preconditions.UID != "" || input.Preconditions.ResourceVersion != "" {
+		uid := k8stypes.UID(input.Preconditions.UID)
+		if uid == "" {
+			uid = current.ObjectMeta.UID
+		}
+		options.Preconditions = &metav1.Preconditions{UID: &uid}
+	}
+
+	return options
+}
+
+func createRESTClient(config *rest.Config) (*rest.RESTClient, error) {
+	v1beta1.AddToScheme(scheme.Scheme)
+
+	crdConfig := *config
+	crdConfig.ContentConfig.GroupVersion = &schema.GroupVersion{Group: v1beta1.GroupName, Version: v1beta1.GroupVersion}
+	crdConfig.APIPath = "/apis"
+	crdConfig.NegotiatedSerializer = serializer.DirectCodecFactory{CodecFactory: scheme.Codecs}
+	crdConfig.UserAgent = rest.DefaultKubernetesUserAgent()
+
+	rc, err := rest.UnversionedRESTClientFor(&crdConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	return rc, nil
+}
+
+func validateInput(input string) error {
+	//log.Printf("request with %s key", input)
+	// TODO: validation
+	return nil
+}
+
+func validateData(input DeleteService) error {
+	if input.ServiceName == "" {
+		return fmt.Errorf("missing service name")
+	}
+
+	switch metav1.DeletionPropagation(input.PropagationPolicy) {
+	case "", metav1.DeletePropagationForeground, metav1.DeletePropagationBackground, metav1.DeletePropagationOrphan:
+	default:
+		return fmt.Errorf("unknown propagation policy %q (use %s, %s or %s)", input.PropagationPolicy,
+			metav1.DeletePropagationForeground, metav1.DeletePropagationBackground, metav1.DeletePropagationOrphan)
+	}
+
+	if input.GracePeriodSeconds != nil && *input.GracePeriodSeconds < 0 {
+		return fmt.Errorf("grace period must not be negative")
+	}
+
+	return nil
+}
+
+// fatalf reports, records, audits, traces and logs the failed request
+// before exiting
+func fatalf(format string, v ...interface{}) {
+	reporter.Reportf(format, v...)
+	recorder.Finish(metrics.OutcomeError)
+	auditor.Record(fmt.Errorf(format, v...))
+	requestTrace.Fail(fmt.Errorf(format, v...))
+	requestTrace.End()
+	logger.Fatalf(format, v...)
+}
@@ -0,0 +1,201 @@
+package function
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/automium/automium-gateway/pkg/apikey"
+	"github.com/automium/automium-gateway/pkg/logging"
+	"github.com/automium/automium-gateway/pkg/metrics"
+	"github.com/automium/automium-gateway/pkg/nodes"
+	"github.com/automium/automium-gateway/pkg/reporting"
+	"github.com/automium/automium-gateway/pkg/tracing"
+	types "github.com/automium/types/go/gateway"
+	v1beta1 "github.com/automium/types/go/v1beta1"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+const defaultNamespace = "default"
+
+//TODO: move to the shared types lib
+type GetService struct {
+	ServiceName string `json:"name"`
+	Namespace   string `json:"namespace"`
+	Nodes       bool   `json:"nodes"`
+	Kubeconfig  string `json:"-"`
+}
+
+//TODO: move to the shared types lib
+type ServiceDetail struct {
+	Service v1beta1.Service `json:"service"`
+	Nodes   []v1beta1.Node  `json:"nodes,omitempty"`
+}
+
+var recorder = metrics.New("getservice")
+var reporter = reporting.New("getservice")
+var logger = logging.New("getservice").TrackPhase(recorder.CurrentPhase)
+var requestTrace = tracing.FromEnv("getservice")
+
+func getAPISecret(secretName string) (secretBytes []byte, err error) {
+	root := "/var/openfaas/secrets/"
+
+	// read from the openfaas secrets folder
+	secretBytes, err = ioutil.ReadFile(root + secretName)
+	return secretBytes, err
+}
+
+// Handle a serverless request
+func Handle(req []byte) string {
+	// The OpenFaaS gateway sets X-Call-Id on every call
+	requestID := logging.RequestID(os.Getenv("Http_X_Request_Id"), os.Getenv("Http_X_Call_Id"))
+	logger.Set(logging.FieldRequestID, requestID)
+	recorder.SetLogger(logger)
+	reporter.Tag(logging.FieldRequestID, requestID)
+	requestTrace.SetAttribute(logging.FieldRequestID, requestID)
+	recorder.OnPhase(requestTrace.Phase)
+	response := handle(req)
+	requestTrace.End()
+	return logging.WithRequestID(response, requestID)
+}
+
+func handle(req []byte) string {
+
+	defer recorder.Finish(metrics.OutcomeSuccess)
+
+	key := os.Getenv("Http_X_Api_Key")
+	reporter.Tag("keyId", apikey.ID(key))
+	logger.Set(logging.FieldKeyID, apikey.ID(key))
+	requestTrace.SetAttribute(logging.FieldKeyID, apikey.ID(key))
+	phase := recorder.Phase(metrics.PhaseAuth)
+	err := validateInput(key)
+	phase.Done(err)
+	if err != nil {
+		fatalf("Invalid input: %s", err.Error())
+	}
+
+	secretBytes, err := getAPISecret("KubeConfig")
+	if err != nil {
+		fatalf("Cannot read secret: %s", err.Error())
+	}
+
+	var kubeConfig types.KubernetesConfig
+	err = json.Unmarshal(secretBytes, &kubeConfig)
+
+	var inputData GetService
+	err = json.Unmarshal(req, &inputData)
+	if err != nil {
+		fatalf("Cannot handle input data: %s", err.Error())
+	}
+	inputData.Kubeconfig = kubeConfig.Kubeconfig
+	if inputData.Namespace == "" {
+		inputData.Namespace = defaultNamespace
+	}
+
+	reporter.Tag("service", inputData.ServiceName)
+	logger.Set(logging.FieldService, inputData.ServiceName)
+	requestTrace.SetAttribute(logging.FieldService, inputData.ServiceName)
+	err = validateData(inputData)
+	if err != nil {
+		fatalf("Invalid data: %s", err.Error())
+	}
+
+	config, err := clientcmd.RESTConfigFromKubeConfig([]byte(inputData.Kubeconfig))
+	if err != nil {
+		fatalf("Cannot create configuration from provided kubeconfig: %s", err.Error())
+	}
+
+	client, err := createRESTClient(config)
+	if err != nil {
+		fatalf("Cannot prepare the client: %s", err.Error())
+	}
+
+	result := ServiceDetail{}
+	phase = recorder.KubernetesPhase("GET", "services", inputData.ServiceName)
+	err = client.Get().Resource("services").Name(inputData.ServiceName).Namespace(inputData.Namespace).Do().Into(&result.Service)
+	phase.Done(err)
+	if err != nil {
+		fatalf("Cannot get service: %s", err.Error())
+	}
+
+	if inputData.Nodes {
+		// Only the nodes carrying the app label of the service are listed,
+		// and the rules of pkg/nodes, shared with infrastatus, relate them to it
+		nodeList := v1beta1.NodeList{}
+		phase = recorder.KubernetesPhase("LIST", "nodes", inputData.ServiceName)
+		err = client.Get().Resource("nodes").Namespace(inputData.Namespace).VersionedParams(&metav1.ListOptions{
+			LabelSelector: labels.SelectorFromSet(labels.Set{nodes.ServiceLabel: nodes.App(result.Service)}).String(),
+		}, scheme.ParameterCodec).Do().Into(&nodeList)
+		phase.Done(err)
+		if err != nil {
+			fatalf("Cannot retrieve nodes: %s", err.Error())
+		}
+		result.Nodes = serviceNodes(result.Service, nodeList.Items)
+	}
+
+	serviceJSON, err := json.Marshal(result)
+	if err != nil {
+		fatalf("Cannot marshal output: %s", err.Error())
+	}
+
+	return string(serviceJSON)
+}
+
+// serviceNodes returns the nodes of the service
+func serviceNodes(service v1beta1.Service, list []v1beta1.Node) []v1beta1.Node {
+	services := []v1beta1.Service{service}
+	var result = []v1beta1.Node{}
+	for _, node := range list {
+		if nodes.Service(node, services) != nil {
+			result = append(result, node)
+		}
+	}
+	return result
+}
+
+func createRESTClient(config *rest.Config) (*rest.RESTClient, error) {
+	v1beta1.AddToScheme(scheme.Scheme)
+
+	crdConfig := *config
+	crdConfig.ContentConfig.GroupVersion = &schema.GroupVersion{Group: v1beta1.GroupName, Version: v1beta1.GroupVersion}
+	crdConfig.APIPath = "/apis"
+	crdConfig.NegotiatedSerializer = serializer.DirectCodecFactory{CodecFactory: scheme.Codecs}
+	crdConfig.UserAgent = rest.DefaultKubernetesUserAgent()
+
+	rc, err := rest.UnversionedRESTClientFor(&crdConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	return rc, nil
+}
+
+func validateInput(input string) error {
+	//log.Printf("request with %s key", input)
+	// TODO: validation
+	return nil
+}
+
+func validateData(input GetService) error {
+	if input.ServiceName == "" {
+		return fmt.Errorf("missing service name")
+	}
+	return nil
+}
+
+// fatalf reports, records, traces and logs the failed request before exiting
+func fatalf(format string, v ...interface{}) {
+	reporter.Reportf(format, v...)
+	recorder.Finish(metrics.OutcomeError)
+	requestTrace.Fail(fmt.Errorf(format, v...))
+	requestTrace.End()
+	logger.Fatalf(format, v...)
+}
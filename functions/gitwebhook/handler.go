@@ -0,0 +1,545 @@
+package function
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/automium/automium-gateway/pkg/audit"
+	"github.com/automium/automium-gateway/pkg/logging"
+	"github.com/automium/automium-gateway/pkg/metrics"
+	"github.com/automium/automium-gateway/pkg/notify"
+	"github.com/automium/automium-gateway/pkg/reporting"
+	"github.com/automium/automium-gateway/pkg/services"
+	"github.com/automium/automium-gateway/pkg/specs"
+	"github.com/automium/automium-gateway/pkg/tracing"
+	types "github.com/automium/types/go/gateway"
+	v1beta1 "github.com/automium/types/go/v1beta1"
+	"github.com/ghodss/yaml"
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	gitssh "gopkg.in/src-d/go-git.v4/plumbing/transport/ssh"
+	"gopkg.in/src-d/go-git.v4/storage/memory"
+	"gopkg.in/src-d/go-git.v4/utils/merkletrie"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+const (
+	providerGitHub = "github"
+	providerGitLab = "gitlab"
+	providerGitea  = "gitea"
+
+	actionApplied = "applied"
+	actionDeleted = "deleted"
+	actionKept    = "kept"
+	actionFailed  = "failed"
+)
+
+//TODO: move to the shared types lib
+type GitSecret struct {
+	GitConfig types.GitConfig `json:"git"`
+	Specs     specs.Layout    `json:"specs"`
+}
+
+//TODO: move to the shared types lib
+type PushEvent struct {
+	Ref    string `json:"ref"`
+	Before string `json:"before"`
+	After  string `json:"after"`
+}
+
+//TODO: move to the shared types lib
+type PushResult struct {
+	Provider string       `json:"provider"`
+	Ref      string       `json:"ref"`
+	Before   string       `json:"before"`
+	After    string       `json:"after"`
+	Changes  []SpecChange `json:"changes"`
+	Message  string       `json:"message,omitempty"`
+}
+
+//TODO: move to the shared types lib
+type SpecChange struct {
+	File            string `json:"file"`
+	Service         string `json:"service"`
+	Action          string `json:"action"`
+	ResourceVersion string `json:"resourceVersion,omitempty"`
+	Error           string `json:"error,omitempty"`
+}
+
+// specFile is a spec added, modified or removed by a push
+type specFile struct {
+	name    string
+	service string
+	removed bool
+	// kept is set on a removed spec whose service is still declared by
+	// another spec, e.g. when the spec is renamed
+	kept    bool
+	content []byte
+}
+
+func getAPISecret(secretName string) (secretBytes []byte, err error) {
+	root := "/var/openfaas/secrets/"
+
+	// read from the openfaas secrets folder
+	secretBytes, err = ioutil.ReadFile(root + secretName)
+	return secretBytes, err
+}
+
+// Handle a push webhook of the specs repository, applying the specs changed
+// by the push and deleting the services whose spec was removed
+func Handle(w http.ResponseWriter, r *http.Request) {
+	metrics.Instrument("gitwebhook", logging.Instrument("gitwebhook", reporting.Instrument("gitwebhook", tracing.Instrument("gitwebhook", handle))))(w, r)
+}
+
+func handle(w http.ResponseWriter, r *http.Request) {
+
+	recorder := metrics.FromRequest(r)
+	logger := logging.FromRequest(r).TrackPhase(recorder.CurrentPhase)
+	recorder.SetLogger(logger)
+	requestID := w.Header().Get(logging.RequestIDHeader)
+	reporting.FromRequest(r).Tag(logging.FieldRequestID, requestID)
+	requestTrace := tracing.FromRequest(r)
+	requestTrace.SetAttribute(logging.FieldRequestID, requestID)
+	recorder.OnPhase(requestTrace.Phase)
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		httpError(w, r, http.StatusBadRequest, "Cannot read input data: %s", err.Error())
+		return
+	}
+
+	provider, event := detectProvider(r.Header)
+	if provider == "" {
+		httpError(w, r, http.StatusBadRequest, "Unknown webhook: expected a GitHub, GitLab or Gitea push event")
+		return
+	}
+
+	webhookSecret, err := getAPISecret("GitWebhook")
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "Cannot read webhook secret: %s", err.Error())
+		return
+	}
+
+	phase := recorder.Phase(metrics.PhaseAuth)
+	err = verifySignature(provider, r.Header, body, strings.TrimSpace(string(webhookSecret)))
+	phase.Done(err)
+	if err != nil {
+		httpError(w, r, http.StatusUnauthorized, "Invalid signature: %s", err.Error())
+		return
+	}
+
+	if !isPush(provider, event) {
+		// e.g. the ping GitHub sends when the webhook is created
+		writeResult(w, r, PushResult{Provider: provider, Changes: []SpecChange{}, Message: fmt.Sprintf("Event %s ignored", event)})
+		return
+	}
+
+	var pushEvent PushEvent
+	err = json.Unmarshal(body, &pushEvent)
+	if err != nil {
+		httpError(w, r, http.StatusBadRequest, "Cannot handle input data: %s", err.Error())
+		return
+	}
+
+	result := PushResult{
+		Provider: provider,
+		Ref:      pushEvent.Ref,
+		Before:   pushEvent.Before,
+		After:    pushEvent.After,
+		Changes:  []SpecChange{},
+	}
+	if plumbing.NewHash(pushEvent.After) == plumbing.ZeroHash {
+		result.Message = "Branch deleted, nothing to apply"
+		writeResult(w, r, result)
+		return
+	}
+
+	secretBytes, err := getAPISecret("GitConfig")
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "Cannot read secret: %s", err.Error())
+		return
+	}
+
+	var gitSecret GitSecret
+	err = json.Unmarshal(secretBytes, &gitSecret)
+	gitConfig := gitSecret.GitConfig
+
+	err = gitSecret.Specs.Validate()
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "Invalid spec layout: %s", err.Error())
+		return
+	}
+
+	secretBytes, err = getAPISecret("KubeConfig")
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "Cannot read kubeconfig: %s", err.Error())
+		return
+	}
+
+	var kubeConfig types.KubernetesConfig
+	err = json.Unmarshal(secretBytes, &kubeConfig)
+
+	// Parse SSH key from input
+	sshKey, err := ssh.ParsePrivateKey([]byte(gitConfig.RepositoryKey))
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "Invalid SSH key: %s", err.Error())
+		return
+	}
+
+	// Clone the whole history in memory, to compare the commits of the push
+	phase = recorder.Phase(metrics.PhaseGitClone)
+	repo, err := git.Clone(memory.NewStorage(), nil, &git.CloneOptions{
+		Auth: returnSSHConfiguration(gitConfig.RepositoryUsername, sshKey),
+		URL:  gitConfig.RepositoryURL,
+	})
+	phase.Done(err)
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "Cannot clone Git repository: %s", err.Error())
+		return
+	}
+
+	// The specs of the cluster are the ones of the default branch
+	head, err := repo.Head()
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "Cannot retrieve HEAD: %s", err.Error())
+		return
+	}
+	if pushEvent.Ref != head.Name().String() {
+		result.Message = fmt.Sprintf("Push to %s ignored: specs are applied from %s", pushEvent.Ref, head.Name().String())
+		writeResult(w, r, result)
+		return
+	}
+
+	files, err := changedSpecs(repo, gitSecret.Specs, pushEvent.Before, pushEvent.After)
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "Cannot compare %s and %s: %s", pushEvent.Before, pushEvent.After, err.Error())
+		return
+	}
+	if len(files) == 0 {
+		result.Message = "No spec changed"
+		writeResult(w, r, result)
+		return
+	}
+
+	config, err := clientcmd.RESTConfigFromKubeConfig([]byte(kubeConfig.Kubeconfig))
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "Cannot create configuration from provided kubeconfig: %s", err.Error())
+		return
+	}
+
+	client, err := createRESTClient(config)
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "Cannot prepare the client: %s", err.Error())
+		return
+	}
+
+	notifier := notify.New("gitwebhook")
+	notifier.SetRequestID(requestID)
+
+	for _, file := range files {
+		change := SpecChange{File: file.name, Service: file.service}
+		if file.kept {
+			change.Action = actionKept
+			result.Changes = append(result.Changes, change)
+			continue
+		}
+
+		auditor := audit.New("gitwebhook")
+		auditor.Request(requestID, body)
+		auditor.Caller("", audit.SourceIP(r.Header.Get("X-Forwarded-For"), r.Header.Get("X-Real-Ip")))
+		auditor.Target(change.Service, services.Namespace)
+		auditor.Commit(pushEvent.After)
+
+		if file.removed {
+			phase = recorder.KubernetesPhase("DELETE", "services", change.Service)
+			err = deleteService(client, change.Service)
+			phase.Done(err)
+			change.Action = actionDeleted
+		} else {
+			var applied v1beta1.Service
+			applied, err = applyService(r.Context(), client, recorder, file.content)
+			change.Action = actionApplied
+			if err == nil {
+				change.ResourceVersion = applied.ObjectMeta.ResourceVersion
+				auditor.ResourceVersion(change.ResourceVersion)
+				notifier.Send(notify.Event{Type: notify.ServiceApplied, Service: change.Service, Namespace: services.Namespace, Commit: pushEvent.After, Object: applied})
+			}
+		}
+
+		auditor.Record(err)
+		if err != nil {
+			change.Action = actionFailed
+			change.Error = err.Error()
+			logger.Errorf("Cannot sync %s: %s", file.name, err.Error())
+		}
+		result.Changes = append(result.Changes, change)
+	}
+
+	writeResult(w, r, result)
+}
+
+// detectProvider tells who sent the webhook, and the event. Gitea also sets
+// the GitHub headers, so it is checked first.
+func detectProvider(header http.Header) (string, string) {
+	if event := header.Get("X-Gitea-Event"); event != "" {
+		return providerGitea, event
+	}
+	if event := header.Get("X-Gitlab-Event"); event != "" {
+		return providerGitLab, event
+	}
+	if event := header.Get("X-GitHub-Event"); event != "" {
+		return providerGitHub, event
+	}
+	return "", ""
+}
+
+func isPush(provider string, event string) bool {
+	if provider == providerGitLab {
+		return event == "Push Hook"
+	}
+	return event == "push"
+}
+
+// verifySignature checks the HMAC signature of GitHub and Gitea, or the
+// token of GitLab
+func verifySignature(provider string, header http.Header, body []byte, secret string) error {
+	if secret == "" {
+		return fmt.Errorf("no webhook secret configured")
+	}
+
+	switch provider {
+	case providerGitLab:
+		if !hmac.Equal([]byte(header.Get("X-Gitlab-Token")), []byte(secret)) {
+			return fmt.Errorf("token mismatch")
+		}
+		return nil
+	case providerGitea:
+		return compareHMAC(header.Get("X-Gitea-Signature"), body, secret)
+	}
+
+	signature := header.Get("X-Hub-Signature-256")
+	if !strings.HasPrefix(signature, "sha256=") {
+		return fmt.Errorf("missing X-Hub-Signature-256")
+	}
+	return compareHMAC(strings.TrimPrefix(signature, "sha256="), body, secret)
+}
+
+func compareHMAC(signature string, body []byte, secret string) error {
+	expected, err := hex.DecodeString(signature)
+	if err != nil || signature == "" {
+		return fmt.Errorf("malformed signature")
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	if !hmac.Equal(mac.Sum(nil), expected) {
+		return fmt.Errorf("signature mismatch")
+	}
+	return nil
+}
+
+// changedSpecs returns the specs added, modified or removed between the
+// commits of the push, removed ones first. Git does not detect renames, so a
+// renamed spec is removed and added: the removed specs whose service is still
+// declared by a spec of the after commit are kept, not to delete the service
+// just applied. A push creating the branch compares with an empty tree.
+func changedSpecs(repo *git.Repository, layout specs.Layout, before string, after string) ([]specFile, error) {
+	afterTree, err := commitTree(repo, after)
+	if err != nil {
+		return nil, err
+	}
+
+	beforeTree := &object.Tree{}
+	if plumbing.NewHash(before) != plumbing.ZeroHash {
+		beforeTree, err = commitTree(repo, before)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	changes, err := object.DiffTree(beforeTree, afterTree)
+	if err != nil {
+		return nil, err
+	}
+
+	declared, err := declaredServices(afterTree, layout)
+	if err != nil {
+		return nil, err
+	}
+
+	var removed, applied []specFile
+	for _, change := range changes {
+		action, err := change.Action()
+		if err != nil {
+			return nil, err
+		}
+
+		if action == merkletrie.Delete {
+			if !layout.Match(change.From.Name) {
+				continue
+			}
+			content, err := fileContent(beforeTree, change.From.Name)
+			if err != nil {
+				return nil, err
+			}
+			file := specFile{name: change.From.Name, removed: true, content: content}
+			file.service = serviceName(file, layout)
+			file.kept = declared[file.service]
+			removed = append(removed, file)
+			continue
+		}
+
+		if !layout.Match(change.To.Name) {
+			continue
+		}
+		content, err := fileContent(afterTree, change.To.Name)
+		if err != nil {
+			return nil, err
+		}
+		file := specFile{name: change.To.Name, content: content}
+		file.service = serviceName(file, layout)
+		applied = append(applied, file)
+	}
+	return append(removed, applied...), nil
+}
+
+// declaredServices returns the names of the services declared by the specs
+// of the tree
+func declaredServices(tree *object.Tree, layout specs.Layout) (map[string]bool, error) {
+	declared := map[string]bool{}
+	err := tree.Files().ForEach(func(f *object.File) error {
+		if !layout.Match(f.Name) {
+			return nil
+		}
+		content, err := f.Contents()
+		if err != nil {
+			return fmt.Errorf("cannot read %s: %s", f.Name, err.Error())
+		}
+		declared[serviceName(specFile{name: f.Name, content: []byte(content)}, layout)] = true
+		return nil
+	})
+	return declared, err
+}
+
+func commitTree(repo *git.Repository, hash string) (*object.Tree, error) {
+	commit, err := repo.CommitObject(plumbing.NewHash(hash))
+	if err != nil {
+		return nil, fmt.Errorf("cannot retrieve commit %s: %s", hash, err.Error())
+	}
+	return commit.Tree()
+}
+
+func fileContent(tree *object.Tree, name string) ([]byte, error) {
+	file, err := tree.File(name)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read %s: %s", name, err.Error())
+	}
+	content, err := file.Contents()
+	if err != nil {
+		return nil, fmt.Errorf("cannot read %s: %s", name, err.Error())
+	}
+	return []byte(content), nil
+}
+
+// serviceName returns the name in the spec, falling back to the file name
+func serviceName(file specFile, layout specs.Layout) string {
+	var inputData types.ApplyService
+	specJSON, err := yaml.YAMLToJSON(file.content)
+	if err == nil && json.Unmarshal(specJSON, &inputData.Service) == nil && inputData.Service.Metadata.Name != "" {
+		return inputData.Service.Metadata.Name
+	}
+	name, _ := layout.Name(file.name)
+	return name
+}
+
+// applyService creates the service of the spec, or updates it when it
+// already exists, the same way applyservice does
+func applyService(ctx context.Context, client *rest.RESTClient, recorder *metrics.Recorder, content []byte) (v1beta1.Service, error) {
+	specJSON, err := yaml.YAMLToJSON(content)
+	if err != nil {
+		return v1beta1.Service{}, fmt.Errorf("cannot parse spec: %s", err.Error())
+	}
+
+	var inputData types.ApplyService
+	err = json.Unmarshal(specJSON, &inputData.Service)
+	if err != nil {
+		return v1beta1.Service{}, fmt.Errorf("cannot parse spec: %s", err.Error())
+	}
+	if inputData.Service.Metadata.Name == "" {
+		return v1beta1.Service{}, fmt.Errorf("missing service name")
+	}
+
+	return services.Apply(ctx, client, recorder, inputData)
+}
+
+// deleteService deletes the service, already deleted being fine
+func deleteService(client *rest.RESTClient, name string) error {
+	err := client.Delete().Resource("services").Name(name).Namespace(services.Namespace).Do().Error()
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+func writeResult(w http.ResponseWriter, r *http.Request, result PushResult) {
+	resultJSON, err := json.Marshal(result)
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "Cannot marshal output: %s", err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(resultJSON)
+}
+
+// httpError logs and answers the error, reporting and tracing the server
+// errors
+func httpError(w http.ResponseWriter, r *http.Request, status int, format string, v ...interface{}) {
+	message := fmt.Sprintf(format, v...)
+	logging.FromRequest(r).Errorf("%s", message)
+	if status >= http.StatusInternalServerError {
+		reporting.FromRequest(r).Reportf(format, v...)
+		tracing.FromRequest(r).Fail(fmt.Errorf(format, v...))
+	}
+	http.Error(w, message, status)
+}
+
+func createRESTClient(config *rest.Config) (*rest.RESTClient, error) {
+	v1beta1.AddToScheme(scheme.Scheme)
+
+	crdConfig := *config
+	crdConfig.ContentConfig.GroupVersion = &schema.GroupVersion{Group: v1beta1.GroupName, Version: v1beta1.GroupVersion}
+	crdConfig.APIPath = "/apis"
+	crdConfig.NegotiatedSerializer = serializer.DirectCodecFactory{CodecFactory: scheme.Codecs}
+	crdConfig.UserAgent = rest.DefaultKubernetesUserAgent()
+
+	rc, err := rest.UnversionedRESTClientFor(&crdConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	return rc, nil
+}
+
+func returnSSHConfiguration(user string, signer ssh.Signer) *gitssh.PublicKeys {
+	obj := &gitssh.PublicKeys{User: user, Signer: signer}
+	// TODO: find a way to check SSH host keys
+	obj.HostKeyCallback = ssh.InsecureIgnoreHostKey()
+	return obj
+}
@@ -0,0 +1,154 @@
+package function
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/automium/automium-gateway/pkg/specs"
+	"gopkg.in/src-d/go-billy.v4/memfs"
+	"gopkg.in/src-d/go-billy.v4/util"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/storage/memory"
+)
+
+func spec(name string, replicas int) string {
+	return fmt.Sprintf("metadata:\n  name: %s\nspec:\n  replicas: %d\n", name, replicas)
+}
+
+func TestChangedSpecs(t *testing.T) {
+	tests := []struct {
+		name     string
+		before   map[string]string
+		after    map[string]string
+		expected []string
+	}{
+		{
+			"renamed spec",
+			map[string]string{"web.yaml": spec("web", 1)},
+			map[string]string{"frontend.yaml": spec("web", 1)},
+			[]string{"kept web.yaml web", "applied frontend.yaml web"},
+		},
+		{
+			"renamed and modified spec",
+			map[string]string{"web.yaml": spec("web", 1), "db.yaml": spec("db", 1)},
+			map[string]string{"frontend.yaml": spec("web", 2), "db.yaml": spec("db", 1)},
+			[]string{"kept web.yaml web", "applied frontend.yaml web"},
+		},
+		{
+			"replaced service",
+			map[string]string{"web.yaml": spec("web", 1)},
+			map[string]string{"api.yaml": spec("api", 1)},
+			[]string{"removed web.yaml web", "applied api.yaml api"},
+		},
+		{
+			"removed spec",
+			map[string]string{"web.yaml": spec("web", 1), "db.yaml": spec("db", 1)},
+			map[string]string{"db.yaml": spec("db", 1)},
+			[]string{"removed web.yaml web"},
+		},
+		{
+			"modified spec and other files",
+			map[string]string{"web.yaml": spec("web", 1), "README.md": "specs"},
+			map[string]string{"web.yaml": spec("web", 3), "README.md": "the specs", "docs/web.yaml": spec("docs", 1)},
+			[]string{"applied web.yaml web"},
+		},
+		{
+			"spec without name",
+			map[string]string{},
+			map[string]string{"cache.yaml": "spec:\n  replicas: 1\n"},
+			[]string{"applied cache.yaml cache"},
+		},
+		{
+			"new branch",
+			nil,
+			map[string]string{"web.yaml": spec("web", 1)},
+			[]string{"applied web.yaml web"},
+		},
+	}
+
+	for _, test := range tests {
+		repo, err := git.Init(memory.NewStorage(), memfs.New())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		before := plumbing.ZeroHash.String()
+		if test.before != nil {
+			before = commit(t, repo, test.before)
+		}
+		after := commit(t, repo, test.after)
+
+		files, err := changedSpecs(repo, specs.Layout{}, before, after)
+		if err != nil {
+			t.Errorf("%s: changedSpecs returned %s", test.name, err.Error())
+			continue
+		}
+
+		var actual []string
+		for _, file := range files {
+			action := actionApplied
+			if file.kept {
+				action = actionKept
+			} else if file.removed {
+				action = "removed"
+			}
+			actual = append(actual, fmt.Sprintf("%s %s %s", action, file.name, file.service))
+		}
+		if !reflect.DeepEqual(actual, test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, actual)
+		}
+	}
+}
+
+// commit replaces the files of the worktree and commits them
+func commit(t *testing.T, repo *git.Repository, files map[string]string) string {
+	worktree, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	head, err := repo.Head()
+	if err == nil {
+		headCommit, err := repo.CommitObject(head.Hash())
+		if err != nil {
+			t.Fatal(err)
+		}
+		tree, err := headCommit.Tree()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tree.Files().ForEach(func(f *object.File) error {
+			if _, ok := files[f.Name]; !ok {
+				_, err := worktree.Remove(f.Name)
+				return err
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for name, content := range files {
+		err = util.WriteFile(worktree.Filesystem, name, []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = worktree.Add(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	hash, err := worktree.Commit("Update specs", &git.CommitOptions{
+		Author: &object.Signature{Name: "automium", Email: "automium@example.com", When: time.Now()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hash.String()
+}
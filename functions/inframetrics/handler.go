@@ -0,0 +1,259 @@
+package function
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+
+	"github.com/automium/automium-gateway/pkg/apikey"
+	"github.com/automium/automium-gateway/pkg/logging"
+	"github.com/automium/automium-gateway/pkg/metrics"
+	"github.com/automium/automium-gateway/pkg/nodes"
+	"github.com/automium/automium-gateway/pkg/reporting"
+	"github.com/automium/automium-gateway/pkg/tracing"
+	types "github.com/automium/types/go/gateway"
+	v1beta1 "github.com/automium/types/go/v1beta1"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// Names of the exported metrics
+const (
+	serviceInfo       = "automium_service_info"
+	serviceReplicas   = "automium_service_replicas"
+	serviceNodes      = "automium_service_nodes"
+	serviceReadyNodes = "automium_service_ready_nodes"
+	nodeInfo          = "automium_node_info"
+	nodeReady         = "automium_node_ready"
+	unassignedNodes   = "automium_unassigned_nodes"
+)
+
+var recorder = metrics.New("inframetrics")
+var reporter = reporting.New("inframetrics")
+var logger = logging.New("inframetrics").TrackPhase(recorder.CurrentPhase)
+var requestTrace = tracing.FromEnv("inframetrics")
+
+func getAPISecret(secretName string) (secretBytes []byte, err error) {
+	root := "/var/openfaas/secrets/"
+
+	// read from the openfaas secrets folder
+	secretBytes, err = ioutil.ReadFile(root + secretName)
+	return secretBytes, err
+}
+
+// Handle a serverless request, rendering the state of the Services and Nodes
+// in the Prometheus text format
+func Handle(req []byte) string {
+	// The OpenFaaS gateway sets X-Call-Id on every call
+	requestID := logging.RequestID(os.Getenv("Http_X_Request_Id"), os.Getenv("Http_X_Call_Id"))
+	logger.Set(logging.FieldRequestID, requestID)
+	recorder.SetLogger(logger)
+	reporter.Tag(logging.FieldRequestID, requestID)
+	requestTrace.SetAttribute(logging.FieldRequestID, requestID)
+	recorder.OnPhase(requestTrace.Phase)
+	response := handle(req)
+	requestTrace.End()
+	// Comments other than HELP and TYPE are ignored by Prometheus
+	return fmt.Sprintf("# %s: %s\n%s", logging.FieldRequestID, requestID, response)
+}
+
+func handle(req []byte) string {
+
+	defer recorder.Finish(metrics.OutcomeSuccess)
+
+	key := os.Getenv("Http_X_Api_Key")
+	reporter.Tag("keyId", apikey.ID(key))
+	logger.Set(logging.FieldKeyID, apikey.ID(key))
+	requestTrace.SetAttribute(logging.FieldKeyID, apikey.ID(key))
+	phase := recorder.Phase(metrics.PhaseAuth)
+	err := validateInput(key)
+	phase.Done(err)
+	if err != nil {
+		fatalf("Invalid input: %s", err.Error())
+	}
+
+	secretBytes, err := getAPISecret("KubeConfig")
+	if err != nil {
+		fatalf("Cannot read secret: %s", err.Error())
+	}
+
+	var inputData types.KubernetesConfig
+	err = json.Unmarshal(secretBytes, &inputData)
+
+	err = validateData(inputData)
+	if err != nil {
+		fatalf("Invalid data: %s", err.Error())
+	}
+
+	// Scrapes are plain GET requests: the namespace comes from the query
+	query, err := url.ParseQuery(os.Getenv("Http_Query"))
+	if err != nil {
+		fatalf("Cannot parse query: %s", err.Error())
+	}
+	namespace := query.Get("namespace")
+
+	config, err := clientcmd.RESTConfigFromKubeConfig([]byte(inputData.Kubeconfig))
+	if err != nil {
+		fatalf("Cannot create configuration from provided kubeconfig: %s", err.Error())
+	}
+
+	client, err := createRESTClient(config)
+	if err != nil {
+		fatalf("Cannot prepare the client: %s", err.Error())
+	}
+
+	services := v1beta1.ServiceList{}
+	phase = recorder.KubernetesPhase("LIST", "services", "")
+	err = client.Get().Resource("services").Namespace(namespace).Do().Into(&services)
+	phase.Done(err)
+	if err != nil {
+		fatalf("Cannot retrieve services: %s", err.Error())
+	}
+
+	nodeList := v1beta1.NodeList{}
+	phase = recorder.KubernetesPhase("LIST", "nodes", "")
+	err = client.Get().Resource("nodes").Namespace(namespace).Do().Into(&nodeList)
+	phase.Done(err)
+	if err != nil {
+		fatalf("Cannot retrieve nodes: %s", err.Error())
+	}
+
+	var output bytes.Buffer
+	err = collect(services.Items, nodeList.Items).Write(&output)
+	if err != nil {
+		fatalf("Cannot render metrics: %s", err.Error())
+	}
+
+	return output.String()
+}
+
+// collect builds the gauges of the services and nodes. The replicas of a
+// service are compared with its ready nodes to alert on a mismatch, e.g.
+// automium_service_replicas != automium_service_ready_nodes
+func collect(services []v1beta1.Service, nodeList []v1beta1.Node) *metrics.Registry {
+	registry := metrics.NewRegistry()
+	registry.Describe(serviceInfo, "Flavor and version of the service.")
+	registry.Describe(serviceReplicas, "Replicas desired by the service.")
+	registry.Describe(serviceNodes, "Nodes belonging to the service.")
+	registry.Describe(serviceReadyNodes, "Nodes of the service in a ready state.")
+	registry.Describe(nodeInfo, "State of the node and the service it belongs to.")
+	registry.Describe(nodeReady, "Whether the node is in a ready state.")
+	registry.Describe(unassignedNodes, "Nodes not belonging to any service.")
+
+	rules := nodes.RulesFromEnv()
+
+	total := map[string]int{}
+	ready := map[string]int{}
+	unassigned := map[string]int{}
+	for _, node := range nodeList {
+		state := rules.State(node)
+		if state == "" {
+			state = "unknown"
+		}
+		isReady := rules.IsReady(state)
+
+		serviceName := ""
+		service := nodes.Service(node, services)
+		if service == nil {
+			unassigned[node.ObjectMeta.Namespace]++
+		} else {
+			serviceName = service.ObjectMeta.Name
+			key := nodes.ServiceKey(*service)
+			total[key]++
+			if isReady {
+				ready[key]++
+			}
+		}
+
+		labels := metrics.Labels{
+			"namespace": node.ObjectMeta.Namespace,
+			"node":      node.ObjectMeta.Name,
+			"service":   serviceName,
+		}
+		registry.Set(nodeReady, labels, boolValue(isReady))
+
+		labels = metrics.Labels{
+			"namespace": node.ObjectMeta.Namespace,
+			"node":      node.ObjectMeta.Name,
+			"service":   serviceName,
+			"state":     state,
+		}
+		registry.Set(nodeInfo, labels, 1)
+	}
+
+	for _, service := range services {
+		key := nodes.ServiceKey(service)
+		labels := metrics.Labels{
+			"namespace": service.ObjectMeta.Namespace,
+			"service":   service.ObjectMeta.Name,
+		}
+		registry.Set(serviceReplicas, labels, float64(service.Spec.Replicas))
+		registry.Set(serviceNodes, labels, float64(total[key]))
+		registry.Set(serviceReadyNodes, labels, float64(ready[key]))
+
+		labels = metrics.Labels{
+			"namespace": service.ObjectMeta.Namespace,
+			"service":   service.ObjectMeta.Name,
+			"flavor":    service.Spec.Flavor,
+			"version":   service.Spec.Version,
+		}
+		registry.Set(serviceInfo, labels, 1)
+	}
+
+	for namespace, count := range unassigned {
+		registry.Set(unassignedNodes, metrics.Labels{"namespace": namespace}, float64(count))
+	}
+
+	return registry
+}
+
+func boolValue(value bool) float64 {
+	if value {
+		return 1
+	}
+	return 0
+}
+
+func createRESTClient(config *rest.Config) (*rest.RESTClient, error) {
+	v1beta1.AddToScheme(scheme.Scheme)
+
+	crdConfig := *config
+	crdConfig.ContentConfig.GroupVersion = &schema.GroupVersion{Group: v1beta1.GroupName, Version: v1beta1.GroupVersion}
+	crdConfig.APIPath = "/apis"
+	crdConfig.NegotiatedSerializer = serializer.DirectCodecFactory{CodecFactory: scheme.Codecs}
+	crdConfig.UserAgent = rest.DefaultKubernetesUserAgent()
+
+	rc, err := rest.UnversionedRESTClientFor(&crdConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	return rc, nil
+}
+
+func validateInput(input string) error {
+	//log.Printf("request with %s key", input)
+	// TODO: validation
+	return nil
+}
+
+func validateData(input types.KubernetesConfig) error {
+	// TODO: validation
+	return nil
+}
+
+// fatalf reports, records, traces and logs the failed request before exiting
+func fatalf(format string, v ...interface{}) {
+	reporter.Reportf(format, v...)
+	recorder.Finish(metrics.OutcomeError)
+	requestTrace.Fail(fmt.Errorf(format, v...))
+	requestTrace.End()
+	logger.Fatalf(format, v...)
+}
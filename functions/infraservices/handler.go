@@ -1,14 +1,23 @@
 package function
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
-	"log"
 	"os"
 
+	"github.com/automium/automium-gateway/pkg/apikey"
+	"github.com/automium/automium-gateway/pkg/logging"
+	"github.com/automium/automium-gateway/pkg/metrics"
+	"github.com/automium/automium-gateway/pkg/reporting"
+	"github.com/automium/automium-gateway/pkg/tracing"
 	types "github.com/automium/types/go/gateway"
 	v1beta1 "github.com/automium/types/go/v1beta1"
 
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/runtime/serializer"
 	"k8s.io/client-go/kubernetes/scheme"
@@ -16,6 +25,20 @@ import (
 	"k8s.io/client-go/tools/clientcmd"
 )
 
+//TODO: move to the shared types lib
+type ListOptions struct {
+	Namespace     string `json:"namespace"`
+	LabelSelector string `json:"labelSelector"`
+	FieldSelector string `json:"fieldSelector"`
+	Limit         int64  `json:"limit"`
+	Continue      string `json:"continue"`
+}
+
+var recorder = metrics.New("infraservices")
+var reporter = reporting.New("infraservices")
+var logger = logging.New("infraservices").TrackPhase(recorder.CurrentPhase)
+var requestTrace = tracing.FromEnv("infraservices")
+
 func getAPISecret(secretName string) (secretBytes []byte, err error) {
 	root := "/var/openfaas/secrets/"
 
@@ -26,16 +49,36 @@ func getAPISecret(secretName string) (secretBytes []byte, err error) {
 
 // Handle a serverless request
 func Handle(req []byte) string {
+	// The OpenFaaS gateway sets X-Call-Id on every call
+	requestID := logging.RequestID(os.Getenv("Http_X_Request_Id"), os.Getenv("Http_X_Call_Id"))
+	logger.Set(logging.FieldRequestID, requestID)
+	recorder.SetLogger(logger)
+	reporter.Tag(logging.FieldRequestID, requestID)
+	requestTrace.SetAttribute(logging.FieldRequestID, requestID)
+	recorder.OnPhase(requestTrace.Phase)
+	response := handle(req)
+	requestTrace.End()
+	return logging.WithRequestID(response, requestID)
+}
+
+func handle(req []byte) string {
+
+	defer recorder.Finish(metrics.OutcomeSuccess)
 
 	key := os.Getenv("Http_x_api_key")
+	reporter.Tag("keyId", apikey.ID(key))
+	logger.Set(logging.FieldKeyID, apikey.ID(key))
+	requestTrace.SetAttribute(logging.FieldKeyID, apikey.ID(key))
+	phase := recorder.Phase(metrics.PhaseAuth)
 	err := validateInput(key)
+	phase.Done(err)
 	if err != nil {
-		log.Fatalf("[ERROR] Invalid input: %s", err.Error())
+		fatalf("Invalid input: %s", err.Error())
 	}
 
 	secretBytes, err := getAPISecret("KubeConfig")
 	if err != nil {
-		log.Fatal(err)
+		fatalf("Cannot read secret: %s", err.Error())
 	}
 
 	var inputData types.KubernetesConfig
@@ -43,28 +86,48 @@ func Handle(req []byte) string {
 
 	err = validateData(inputData)
 	if err != nil {
-		log.Fatalf("[ERROR] Invalid data: %s", err.Error())
+		fatalf("Invalid data: %s", err.Error())
+	}
+
+	var listOptions ListOptions
+	if len(bytes.TrimSpace(req)) > 0 {
+		err = json.Unmarshal(req, &listOptions)
+		if err != nil {
+			fatalf("Cannot handle input data: %s", err.Error())
+		}
+	}
+
+	err = validateListOptions(listOptions)
+	if err != nil {
+		fatalf("Invalid list options: %s", err.Error())
 	}
 
 	config, err := clientcmd.RESTConfigFromKubeConfig([]byte(inputData.Kubeconfig))
 	if err != nil {
-		log.Fatalf("[ERROR] Cannot create configuration from provided kubeconfig: %s", err.Error())
+		fatalf("Cannot create configuration from provided kubeconfig: %s", err.Error())
 	}
 
 	client, err := createRESTClient(config)
 	if err != nil {
-		log.Fatalf("[ERROR] Cannot prepare the client: %s", err.Error())
+		fatalf("Cannot prepare the client: %s", err.Error())
 	}
 
 	result := v1beta1.ServiceList{}
-	err = client.Get().Resource("services").Do().Into(&result)
+	phase = recorder.KubernetesPhase("LIST", "services", "")
+	err = client.Get().Resource("services").Namespace(listOptions.Namespace).VersionedParams(&metav1.ListOptions{
+		LabelSelector: listOptions.LabelSelector,
+		FieldSelector: listOptions.FieldSelector,
+		Limit:         listOptions.Limit,
+		Continue:      listOptions.Continue,
+	}, scheme.ParameterCodec).Do().Into(&result)
+	phase.Done(err)
 	if err != nil {
-		log.Fatalf("[ERROR] Cannot retrieve services: %s", err.Error())
+		fatalf("Cannot retrieve services: %s", err.Error())
 	}
 
 	serviceListJSON, err := json.Marshal(result)
 	if err != nil {
-		log.Fatalf("[ERROR] Cannot marshal output: %s", err.Error())
+		fatalf("Cannot marshal output: %s", err.Error())
 	}
 
 	return string(serviceListJSON)
@@ -97,3 +160,30 @@ func validateData(input types.KubernetesConfig) error {
 	// TODO: validation
 	return nil
 }
+
+func validateListOptions(input ListOptions) error {
+	if input.Limit < 0 {
+		return fmt.Errorf("limit must not be negative")
+	}
+
+	_, err := labels.Parse(input.LabelSelector)
+	if err != nil {
+		return fmt.Errorf("invalid label selector: %s", err.Error())
+	}
+
+	_, err = fields.ParseSelector(input.FieldSelector)
+	if err != nil {
+		return fmt.Errorf("invalid field selector: %s", err.Error())
+	}
+
+	return nil
+}
+
+// fatalf reports, records, traces and logs the failed request before exiting
+func fatalf(format string, v ...interface{}) {
+	reporter.Reportf(format, v...)
+	recorder.Finish(metrics.OutcomeError)
+	requestTrace.Fail(fmt.Errorf(format, v...))
+	requestTrace.End()
+	logger.Fatalf(format, v...)
+}
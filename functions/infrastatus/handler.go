@@ -1,14 +1,24 @@
 package function
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
-	"log"
 	"os"
 
+	"github.com/automium/automium-gateway/pkg/apikey"
+	"github.com/automium/automium-gateway/pkg/logging"
+	"github.com/automium/automium-gateway/pkg/metrics"
+	"github.com/automium/automium-gateway/pkg/nodes"
+	"github.com/automium/automium-gateway/pkg/reporting"
+	"github.com/automium/automium-gateway/pkg/tracing"
 	types "github.com/automium/types/go/gateway"
 	v1beta1 "github.com/automium/types/go/v1beta1"
 
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/runtime/serializer"
 	"k8s.io/client-go/kubernetes/scheme"
@@ -16,6 +26,51 @@ import (
 	"k8s.io/client-go/tools/clientcmd"
 )
 
+//TODO: move to the shared types lib
+type ListOptions struct {
+	Namespace     string `json:"namespace"`
+	LabelSelector string `json:"labelSelector"`
+	FieldSelector string `json:"fieldSelector"`
+	Limit         int64  `json:"limit"`
+	Continue      string `json:"continue"`
+}
+
+//TODO: move to the shared types lib
+type StatusOptions struct {
+	ListOptions
+	Summary bool `json:"summary"`
+}
+
+//TODO: move to the shared types lib
+type StatusSummary struct {
+	Status         string            `json:"status"`
+	Nodes          int               `json:"nodes"`
+	NodesByState   map[string]int    `json:"nodesByState"`
+	NodesByService map[string]int    `json:"nodesByService"`
+	Unassigned     []string          `json:"unassigned"`
+	NotReporting   []string          `json:"notReporting"`
+	Mismatched     []ServiceReplicas `json:"mismatched"`
+}
+
+//TODO: move to the shared types lib
+type ServiceReplicas struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+	Desired   int    `json:"desired"`
+	Ready     int    `json:"ready"`
+}
+
+const (
+	statusOK       = "OK"
+	statusDegraded = "DEGRADED"
+	statusDown     = "DOWN"
+)
+
+var recorder = metrics.New("infrastatus")
+var reporter = reporting.New("infrastatus")
+var logger = logging.New("infrastatus").TrackPhase(recorder.CurrentPhase)
+var requestTrace = tracing.FromEnv("infrastatus")
+
 func getAPISecret(secretName string) (secretBytes []byte, err error) {
 	root := "/var/openfaas/secrets/"
 
@@ -26,16 +81,36 @@ func getAPISecret(secretName string) (secretBytes []byte, err error) {
 
 // Handle a serverless request
 func Handle(req []byte) string {
+	// The OpenFaaS gateway sets X-Call-Id on every call
+	requestID := logging.RequestID(os.Getenv("Http_X_Request_Id"), os.Getenv("Http_X_Call_Id"))
+	logger.Set(logging.FieldRequestID, requestID)
+	recorder.SetLogger(logger)
+	reporter.Tag(logging.FieldRequestID, requestID)
+	requestTrace.SetAttribute(logging.FieldRequestID, requestID)
+	recorder.OnPhase(requestTrace.Phase)
+	response := handle(req)
+	requestTrace.End()
+	return logging.WithRequestID(response, requestID)
+}
+
+func handle(req []byte) string {
+
+	defer recorder.Finish(metrics.OutcomeSuccess)
 
 	key := os.Getenv("Http_X_Api_Key")
+	reporter.Tag("keyId", apikey.ID(key))
+	logger.Set(logging.FieldKeyID, apikey.ID(key))
+	requestTrace.SetAttribute(logging.FieldKeyID, apikey.ID(key))
+	phase := recorder.Phase(metrics.PhaseAuth)
 	err := validateInput(key)
+	phase.Done(err)
 	if err != nil {
-		log.Fatalf("[ERROR] Invalid input: %s", err.Error())
+		fatalf("Invalid input: %s", err.Error())
 	}
 
 	secretBytes, err := getAPISecret("KubeConfig")
 	if err != nil {
-		log.Fatal(err)
+		fatalf("Cannot read secret: %s", err.Error())
 	}
 
 	var inputData types.KubernetesConfig
@@ -43,31 +118,146 @@ func Handle(req []byte) string {
 
 	err = validateData(inputData)
 	if err != nil {
-		log.Fatalf("[ERROR] Invalid data: %s", err.Error())
+		fatalf("Invalid data: %s", err.Error())
+	}
+
+	var statusOptions StatusOptions
+	if len(bytes.TrimSpace(req)) > 0 {
+		err = json.Unmarshal(req, &statusOptions)
+		if err != nil {
+			fatalf("Cannot handle input data: %s", err.Error())
+		}
+	}
+	listOptions := statusOptions.ListOptions
+
+	err = validateListOptions(listOptions)
+	if err != nil {
+		fatalf("Invalid list options: %s", err.Error())
 	}
 
 	config, err := clientcmd.RESTConfigFromKubeConfig([]byte(inputData.Kubeconfig))
 	if err != nil {
-		log.Fatalf("[ERROR] Cannot create configuration from provided kubeconfig: %s", err.Error())
+		fatalf("Cannot create configuration from provided kubeconfig: %s", err.Error())
 	}
 
 	client, err := createRESTClient(config)
 	if err != nil {
-		log.Fatalf("[ERROR] Cannot prepare the client: %s", err.Error())
+		fatalf("Cannot prepare the client: %s", err.Error())
+	}
+
+	if statusOptions.Summary {
+		// The summary covers every node, so pagination does not apply
+		listOptions.Limit = 0
+		listOptions.Continue = ""
 	}
 
 	result := v1beta1.NodeList{}
-	err = client.Get().Resource("nodes").Do().Into(&result)
+	phase = recorder.KubernetesPhase("LIST", "nodes", "")
+	err = client.Get().Resource("nodes").Namespace(listOptions.Namespace).VersionedParams(&metav1.ListOptions{
+		LabelSelector: listOptions.LabelSelector,
+		FieldSelector: listOptions.FieldSelector,
+		Limit:         listOptions.Limit,
+		Continue:      listOptions.Continue,
+	}, scheme.ParameterCodec).Do().Into(&result)
+	phase.Done(err)
 	if err != nil {
-		log.Fatalf("[ERROR] Cannot retrieve nodes: %s", err.Error())
+		fatalf("Cannot retrieve nodes: %s", err.Error())
+	}
+
+	if !statusOptions.Summary {
+		nodeListJSON, err := json.Marshal(result)
+		if err != nil {
+			fatalf("Cannot marshal output: %s", err.Error())
+		}
+
+		return string(nodeListJSON)
 	}
 
-	nodeListJSON, err := json.Marshal(result)
+	services := v1beta1.ServiceList{}
+	phase = recorder.KubernetesPhase("LIST", "services", "")
+	err = client.Get().Resource("services").Namespace(listOptions.Namespace).Do().Into(&services)
+	phase.Done(err)
 	if err != nil {
-		log.Fatalf("[ERROR] Cannot marshal output: %s", err.Error())
+		fatalf("Cannot retrieve services: %s", err.Error())
 	}
 
-	return string(nodeListJSON)
+	// The services cannot be filtered with the selectors of the nodes
+	selected := listOptions.LabelSelector != "" || listOptions.FieldSelector != ""
+	summaryJSON, err := json.Marshal(summarize(result.Items, services.Items, selected))
+	if err != nil {
+		fatalf("Cannot marshal output: %s", err.Error())
+	}
+
+	return string(summaryJSON)
+}
+
+// summarize computes the health of the infrastructure from the nodes and
+// the services they belong to. When the nodes are selected, only the services
+// with selected nodes are compared.
+func summarize(nodeList []v1beta1.Node, services []v1beta1.Service, selected bool) StatusSummary {
+	summary := StatusSummary{
+		Nodes:          len(nodeList),
+		NodesByState:   map[string]int{},
+		NodesByService: map[string]int{},
+		Unassigned:     []string{},
+		NotReporting:   []string{},
+		Mismatched:     []ServiceReplicas{},
+	}
+
+	rules := nodes.RulesFromEnv()
+
+	ready := map[string]int{}
+	for _, node := range nodeList {
+		state := rules.State(node)
+		if state == "" {
+			summary.NotReporting = append(summary.NotReporting, node.ObjectMeta.Name)
+			state = "unknown"
+		}
+		summary.NodesByState[state]++
+
+		service := nodes.Service(node, services)
+		if service == nil {
+			summary.Unassigned = append(summary.Unassigned, node.ObjectMeta.Name)
+			continue
+		}
+		key := nodes.ServiceKey(*service)
+		summary.NodesByService[key]++
+		if rules.IsReady(state) {
+			ready[key]++
+		}
+	}
+
+	// The infrastructure is down when services want nodes but none is ready
+	wanted, serving := false, false
+	for _, service := range services {
+		key := nodes.ServiceKey(service)
+		if selected && summary.NodesByService[key] == 0 {
+			continue
+		}
+		desired := int(service.Spec.Replicas)
+		if desired > 0 {
+			wanted = true
+			serving = serving || ready[key] > 0
+		}
+		if ready[key] != desired {
+			summary.Mismatched = append(summary.Mismatched, ServiceReplicas{
+				Name:      service.ObjectMeta.Name,
+				Namespace: service.ObjectMeta.Namespace,
+				Desired:   desired,
+				Ready:     ready[key],
+			})
+		}
+	}
+
+	switch {
+	case len(summary.Mismatched) == 0 && len(summary.NotReporting) == 0:
+		summary.Status = statusOK
+	case wanted && !serving:
+		summary.Status = statusDown
+	default:
+		summary.Status = statusDegraded
+	}
+	return summary
 }
 
 func createRESTClient(config *rest.Config) (*rest.RESTClient, error) {
@@ -97,3 +287,30 @@ func validateData(input types.KubernetesConfig) error {
 	// TODO: validation
 	return nil
 }
+
+func validateListOptions(input ListOptions) error {
+	if input.Limit < 0 {
+		return fmt.Errorf("limit must not be negative")
+	}
+
+	_, err := labels.Parse(input.LabelSelector)
+	if err != nil {
+		return fmt.Errorf("invalid label selector: %s", err.Error())
+	}
+
+	_, err = fields.ParseSelector(input.FieldSelector)
+	if err != nil {
+		return fmt.Errorf("invalid field selector: %s", err.Error())
+	}
+
+	return nil
+}
+
+// fatalf reports, records, traces and logs the failed request before exiting
+func fatalf(format string, v ...interface{}) {
+	reporter.Reportf(format, v...)
+	recorder.Finish(metrics.OutcomeError)
+	requestTrace.Fail(fmt.Errorf(format, v...))
+	requestTrace.End()
+	logger.Fatalf(format, v...)
+}
@@ -0,0 +1,471 @@
+package function
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/automium/automium-gateway/pkg/apikey"
+	"github.com/automium/automium-gateway/pkg/audit"
+	"github.com/automium/automium-gateway/pkg/logging"
+	"github.com/automium/automium-gateway/pkg/metrics"
+	"github.com/automium/automium-gateway/pkg/notify"
+	"github.com/automium/automium-gateway/pkg/reporting"
+	"github.com/automium/automium-gateway/pkg/specs"
+	"github.com/automium/automium-gateway/pkg/tracing"
+	types "github.com/automium/types/go/gateway"
+	"github.com/ghodss/yaml"
+	"github.com/satori/go.uuid"
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	gitssh "gopkg.in/src-d/go-git.v4/plumbing/transport/ssh"
+	"gopkg.in/src-d/go-git.v4/storage/memory"
+)
+
+var recorder = metrics.New("promotespec")
+var reporter = reporting.New("promotespec")
+var logger = logging.New("promotespec").TrackPhase(recorder.CurrentPhase)
+var requestTrace = tracing.FromEnv("promotespec")
+var auditor = audit.New("promotespec")
+var notifier = notify.New("promotespec")
+
+func getAPISecret(secretName string) (secretBytes []byte, err error) {
+	root := "/var/openfaas/secrets/"
+
+	// read from the openfaas secrets folder
+	secretBytes, err = ioutil.ReadFile(root + secretName)
+	return secretBytes, err
+}
+
+//TODO: move to the shared types lib
+type GitSecret struct {
+	GitConfig    types.GitConfig        `json:"git"`
+	Specs        specs.Layout           `json:"specs"`
+	Environments map[string]Environment `json:"environments"`
+}
+
+//TODO: move to the shared types lib
+type Environment struct {
+	// The repository of the git configuration is used when empty
+	RepositoryURL      string `json:"url"`
+	RepositoryUsername string `json:"username"`
+	RepositoryKey      string `json:"key"`
+	Branch             string `json:"branch"`
+	// The spec root is used when empty
+	Directory string        `json:"directory"`
+	Overrides SpecOverrides `json:"overrides"`
+}
+
+//TODO: move to the shared types lib
+type SpecOverrides struct {
+	Replicas *int              `json:"replicas,omitempty"`
+	Flavor   string            `json:"flavor,omitempty"`
+	Env      map[string]string `json:"env,omitempty"`
+}
+
+//TODO: move to the shared types lib
+type PromoteSpec struct {
+	ServiceName string        `json:"name"`
+	Source      string        `json:"source"`
+	Target      string        `json:"target"`
+	Overrides   SpecOverrides `json:"overrides"`
+}
+
+//TODO: move to the shared types lib
+type PromoteResult struct {
+	Status       string      `json:"status"`
+	Source       string      `json:"source"`
+	Target       string      `json:"target"`
+	SourceCommit string      `json:"sourceCommit"`
+	Commit       string      `json:"commit,omitempty"`
+	Spec         interface{} `json:"spec"`
+}
+
+// Handle a serverless request
+func Handle(req []byte) string {
+	// The OpenFaaS gateway sets X-Call-Id on every call
+	requestID := logging.RequestID(os.Getenv("Http_X_Request_Id"), os.Getenv("Http_X_Call_Id"))
+	logger.Set(logging.FieldRequestID, requestID)
+	recorder.SetLogger(logger)
+	reporter.Tag(logging.FieldRequestID, requestID)
+	requestTrace.SetAttribute(logging.FieldRequestID, requestID)
+	recorder.OnPhase(requestTrace.Phase)
+	auditor.Request(requestID, req)
+	notifier.SetRequestID(requestID)
+	response := handle(req)
+	auditor.Record(nil)
+	requestTrace.End()
+	return logging.WithRequestID(response, requestID)
+}
+
+func handle(req []byte) string {
+
+	defer recorder.Finish(metrics.OutcomeSuccess)
+
+	key := os.Getenv("Http_X_Api_Key")
+	reporter.Tag("keyId", apikey.ID(key))
+	logger.Set(logging.FieldKeyID, apikey.ID(key))
+	requestTrace.SetAttribute(logging.FieldKeyID, apikey.ID(key))
+	auditor.Caller(apikey.ID(key), audit.SourceIP(os.Getenv("Http_X_Forwarded_For"), os.Getenv("Http_X_Real_Ip")))
+	phase := recorder.Phase(metrics.PhaseAuth)
+	err := validateInput(key)
+	phase.Done(err)
+	if err != nil {
+		fatalf("Invalid input: %s", err.Error())
+	}
+
+	secretBytes, err := getAPISecret("GitConfig")
+	if err != nil {
+		fatalf("Cannot read secret: %s", err.Error())
+	}
+
+	var gitSecret GitSecret
+	err = json.Unmarshal(secretBytes, &gitSecret)
+
+	var inputData PromoteSpec
+	err = json.Unmarshal(req, &inputData)
+	if err != nil {
+		fatalf("Cannot parse incoming data: %s", err.Error())
+	}
+
+	reporter.Tag("service", inputData.ServiceName)
+	logger.Set(logging.FieldService, inputData.ServiceName)
+	requestTrace.SetAttribute(logging.FieldService, inputData.ServiceName)
+	auditor.Target(inputData.ServiceName, "")
+	err = validateData(inputData, gitSecret)
+	if err != nil {
+		fatalf("Invalid data: %s", err.Error())
+	}
+
+	source := environment(gitSecret, inputData.Source)
+	target := environment(gitSecret, inputData.Target)
+	sourcePath, err := specs.Layout{Root: source.Directory, Pattern: gitSecret.Specs.Pattern}.Path(inputData.ServiceName)
+	if err != nil {
+		fatalf("Invalid data: %s", err.Error())
+	}
+	targetLayout := specs.Layout{Root: target.Directory, Pattern: gitSecret.Specs.Pattern}
+	targetPath, err := targetLayout.Path(inputData.ServiceName)
+	if err != nil {
+		fatalf("Invalid data: %s", err.Error())
+	}
+
+	// Parse SSH keys from the environments
+	sourceKey, err := ssh.ParsePrivateKey([]byte(source.RepositoryKey))
+	if err != nil {
+		fatalf("Invalid SSH key of %s: %s", inputData.Source, err.Error())
+	}
+	targetKey, err := ssh.ParsePrivateKey([]byte(target.RepositoryKey))
+	if err != nil {
+		fatalf("Invalid SSH key of %s: %s", inputData.Target, err.Error())
+	}
+
+	// Read the spec from the source, in memory
+	phase = recorder.Phase(metrics.PhaseGitClone)
+	sourceRepo, err := git.Clone(memory.NewStorage(), nil, &git.CloneOptions{
+		Auth:          returnSSHConfiguration(source.RepositoryUsername, sourceKey),
+		URL:           source.RepositoryURL,
+		ReferenceName: branchReference(source.Branch),
+		SingleBranch:  true,
+		Depth:         1,
+	})
+	phase.Done(err)
+	if err != nil {
+		fatalf("Cannot checkout %s Git repository: %s", inputData.Source, err.Error())
+	}
+
+	sourceHead, err := sourceRepo.Head()
+	if err != nil {
+		fatalf("Cannot retrieve %s HEAD: %s", inputData.Source, err.Error())
+	}
+
+	sourceCommit, err := sourceRepo.CommitObject(sourceHead.Hash())
+	if err != nil {
+		fatalf("Cannot retrieve %s commit: %s", inputData.Source, err.Error())
+	}
+
+	sourceFile, err := sourceCommit.File(sourcePath)
+	if err != nil {
+		fatalf("Cannot find %s spec in %s: %s", inputData.ServiceName, inputData.Source, err.Error())
+	}
+
+	content, err := sourceFile.Contents()
+	if err != nil {
+		fatalf("Cannot read %s spec in %s: %s", inputData.ServiceName, inputData.Source, err.Error())
+	}
+
+	spec, err := yaml.YAMLToJSON([]byte(content))
+	if err != nil {
+		fatalf("Cannot parse %s spec in %s: %s", inputData.ServiceName, inputData.Source, err.Error())
+	}
+
+	var service map[string]interface{}
+	err = json.Unmarshal(spec, &service)
+	if err != nil {
+		fatalf("Cannot parse %s spec in %s: %s", inputData.ServiceName, inputData.Source, err.Error())
+	}
+
+	// The overrides of the request win over the ones of the environment
+	applyOverrides(service, target.Overrides)
+	applyOverrides(service, inputData.Overrides)
+
+	spec, err = json.Marshal(service)
+	if err != nil {
+		fatalf("Cannot marshal service spec: %s", err.Error())
+	}
+
+	promoted, err := yaml.JSONToYAML(spec)
+	if err != nil {
+		fatalf("Cannot convert service spec to yaml: %s", err.Error())
+	}
+
+	// Generate a working directory
+	workingDirectoryPath := fmt.Sprintf("/home/app/gitrepo_%s", uuid.NewV4().String())
+	err = os.Mkdir(workingDirectoryPath, 0700)
+	if err != nil {
+		fatalf("Cannot prepare temporary working dir: %s", err.Error())
+	}
+
+	// Clone the target repo
+	phase = recorder.Phase(metrics.PhaseGitClone)
+	repo, err := git.PlainClone(workingDirectoryPath, false, &git.CloneOptions{
+		Auth:          returnSSHConfiguration(target.RepositoryUsername, targetKey),
+		URL:           target.RepositoryURL,
+		ReferenceName: branchReference(target.Branch),
+		SingleBranch:  true,
+	})
+	phase.Done(err)
+	if err != nil {
+		cleanup(workingDirectoryPath)
+		fatalf("Cannot checkout %s Git repository: %s", inputData.Target, err.Error())
+	}
+
+	// Create or update the file
+	err = os.MkdirAll(path.Join(workingDirectoryPath, targetLayout.Dir()), 0700)
+	if err != nil {
+		cleanup(workingDirectoryPath)
+		fatalf("Cannot prepare %s directory: %s", inputData.Target, err.Error())
+	}
+
+	err = ioutil.WriteFile(path.Join(workingDirectoryPath, targetPath), promoted, 0600)
+	if err != nil {
+		cleanup(workingDirectoryPath)
+		fatalf("Cannot update file with spec: %s", err.Error())
+	}
+
+	// Retrieve the working tree
+	workingTree, err := repo.Worktree()
+	if err != nil {
+		cleanup(workingDirectoryPath)
+		fatalf("Cannot move to working tree: %s", err.Error())
+	}
+
+	// Add the file
+	_, err = workingTree.Add(targetPath)
+	if err != nil {
+		cleanup(workingDirectoryPath)
+		fatalf("Cannot add file to commit: %s", err.Error())
+	}
+
+	result := PromoteResult{
+		Status:       "OK",
+		Source:       inputData.Source,
+		Target:       inputData.Target,
+		SourceCommit: sourceHead.Hash().String(),
+		Spec:         service,
+	}
+
+	// Nothing to commit when the target already has the promoted spec
+	status, err := workingTree.Status()
+	if err != nil {
+		cleanup(workingDirectoryPath)
+		fatalf("Cannot retrieve working tree status: %s", err.Error())
+	}
+	if status.IsClean() {
+		cleanup(workingDirectoryPath)
+		result.Status = "UNCHANGED"
+		return promoteOutput(result)
+	}
+
+	// Commit the change
+	phase = recorder.Phase(metrics.PhaseGitCommit)
+	commit, err := workingTree.Commit(fmt.Sprintf("[AUTOMIUM] Promote %s spec from %s to %s\n\nSource commit: %s", inputData.ServiceName, inputData.Source, inputData.Target, sourceHead.Hash().String()), &git.CommitOptions{Author: &object.Signature{
+		Name:  "Automium Bot",
+		Email: "automium-bot@automium.io",
+		When:  time.Now(),
+	}})
+	phase.Done(err)
+	if err != nil {
+		cleanup(workingDirectoryPath)
+		fatalf("Cannot commit: %s", err.Error())
+	}
+	auditor.Commit(commit.String())
+
+	// Push the change to the remote repository
+	phase = recorder.Phase(metrics.PhaseGitPush)
+	err = repo.Push(&git.PushOptions{
+		Auth: returnSSHConfiguration(target.RepositoryUsername, targetKey),
+	})
+	phase.Done(err)
+	if err != nil {
+		cleanup(workingDirectoryPath)
+		fatalf("Cannot push: %s", err.Error())
+	}
+
+	// Cleanup...
+	cleanup(workingDirectoryPath)
+
+	notifier.Send(notify.Event{Type: notify.SpecPromoted, Service: inputData.ServiceName, Commit: commit.String(), Source: result.Source, Target: result.Target, SourceCommit: result.SourceCommit})
+
+	// ...and we're good to go!
+	result.Commit = commit.String()
+	return promoteOutput(result)
+}
+
+// environment returns the named environment, completed with the repository
+// of the git configuration
+func environment(gitSecret GitSecret, name string) Environment {
+	env := gitSecret.Environments[name]
+	if env.RepositoryURL == "" {
+		env.RepositoryURL = gitSecret.GitConfig.RepositoryURL
+	}
+	if env.RepositoryUsername == "" {
+		env.RepositoryUsername = gitSecret.GitConfig.RepositoryUsername
+	}
+	if env.RepositoryKey == "" {
+		env.RepositoryKey = gitSecret.GitConfig.RepositoryKey
+	}
+	if env.Directory == "" {
+		env.Directory = gitSecret.Specs.Root
+	}
+	return env
+}
+
+// branchReference returns the reference of the branch, or the remote HEAD
+// when no branch is set
+func branchReference(branch string) plumbing.ReferenceName {
+	if branch == "" {
+		return plumbing.HEAD
+	}
+	return plumbing.NewBranchReferenceName(branch)
+}
+
+// applyOverrides changes the replicas, the flavor and the environment
+// variables of the service spec
+func applyOverrides(service map[string]interface{}, overrides SpecOverrides) {
+	spec, ok := service["spec"].(map[string]interface{})
+	if !ok {
+		spec = map[string]interface{}{}
+		service["spec"] = spec
+	}
+
+	if overrides.Replicas != nil {
+		spec["replicas"] = *overrides.Replicas
+	}
+	if overrides.Flavor != "" {
+		spec["flavor"] = overrides.Flavor
+	}
+	if len(overrides.Env) == 0 {
+		return
+	}
+
+	names := make([]string, 0, len(overrides.Env))
+	for name := range overrides.Env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// The variables are either a map or a list of {name, value}
+	switch env := spec["env"].(type) {
+	case map[string]interface{}:
+		for _, name := range names {
+			env[name] = overrides.Env[name]
+		}
+	case []interface{}:
+		for _, name := range names {
+			found := false
+			for _, item := range env {
+				variable, ok := item.(map[string]interface{})
+				if ok && variable["name"] == name {
+					variable["value"] = overrides.Env[name]
+					found = true
+				}
+			}
+			if !found {
+				env = append(env, map[string]interface{}{"name": name, "value": overrides.Env[name]})
+			}
+		}
+		spec["env"] = env
+	default:
+		var variables []interface{}
+		for _, name := range names {
+			variables = append(variables, map[string]interface{}{"name": name, "value": overrides.Env[name]})
+		}
+		spec["env"] = variables
+	}
+}
+
+func promoteOutput(result PromoteResult) string {
+	output, err := json.Marshal(result)
+	if err != nil {
+		fatalf("Cannot marshal output: %s", err.Error())
+	}
+	return string(output)
+}
+
+func validateInput(input string) error {
+	//log.Printf("request with %s key", input)
+	// TODO: validation
+	return nil
+}
+
+func validateData(input PromoteSpec, gitSecret GitSecret) error {
+	if input.ServiceName == "" {
+		return fmt.Errorf("missing name")
+	}
+	err := specs.ValidateName(input.ServiceName)
+	if err != nil {
+		return err
+	}
+	if input.Source == input.Target {
+		return fmt.Errorf("source and target are both %s", input.Source)
+	}
+	for _, name := range []string{input.Source, input.Target} {
+		env, ok := gitSecret.Environments[name]
+		if !ok {
+			return fmt.Errorf("unknown environment %s", name)
+		}
+		err = specs.Layout{Root: env.Directory, Pattern: gitSecret.Specs.Pattern}.Validate()
+		if err != nil {
+			return fmt.Errorf("invalid spec layout of %s: %s", name, err.Error())
+		}
+	}
+	return gitSecret.Specs.Validate()
+}
+
+func cleanup(path string) {
+	os.RemoveAll(path)
+}
+
+func returnSSHConfiguration(user string, signer ssh.Signer) *gitssh.PublicKeys {
+	obj := &gitssh.PublicKeys{User: user, Signer: signer}
+	// TODO: find a way to check SSH host keys
+	obj.HostKeyCallback = ssh.InsecureIgnoreHostKey()
+	return obj
+}
+
+// fatalf reports, records, audits, traces and logs the failed request
+// before exiting
+func fatalf(format string, v ...interface{}) {
+	reporter.Reportf(format, v...)
+	recorder.Finish(metrics.OutcomeError)
+	auditor.Record(fmt.Errorf(format, v...))
+	requestTrace.Fail(fmt.Errorf(format, v...))
+	requestTrace.End()
+	logger.Fatalf(format, v...)
+}
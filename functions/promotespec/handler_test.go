@@ -0,0 +1,74 @@
+package function
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestApplyOverrides(t *testing.T) {
+	replicas := 3
+	tests := []struct {
+		name      string
+		spec      string
+		overrides SpecOverrides
+		expected  string
+	}{
+		{
+			"no overrides",
+			`{"spec": {"replicas": 1, "env": {"LOG": "debug"}}}`,
+			SpecOverrides{},
+			`{"spec": {"replicas": 1, "env": {"LOG": "debug"}}}`,
+		},
+		{
+			"replicas and flavor",
+			`{"spec": {"replicas": 1, "flavor": "small"}}`,
+			SpecOverrides{Replicas: &replicas, Flavor: "large"},
+			`{"spec": {"replicas": 3, "flavor": "large"}}`,
+		},
+		{
+			"no spec",
+			`{"metadata": {"name": "web"}}`,
+			SpecOverrides{Flavor: "large"},
+			`{"metadata": {"name": "web"}, "spec": {"flavor": "large"}}`,
+		},
+		{
+			"env map",
+			`{"spec": {"env": {"LOG": "debug", "PORT": "80"}}}`,
+			SpecOverrides{Env: map[string]string{"LOG": "info", "REGION": "eu"}},
+			`{"spec": {"env": {"LOG": "info", "PORT": "80", "REGION": "eu"}}}`,
+		},
+		{
+			"env list",
+			`{"spec": {"env": [{"name": "PORT", "value": "80"}, {"name": "LOG", "value": "debug"}]}}`,
+			SpecOverrides{Env: map[string]string{"REGION": "eu", "LOG": "info", "CACHE": "on"}},
+			`{"spec": {"env": [{"name": "PORT", "value": "80"}, {"name": "LOG", "value": "info"}, {"name": "CACHE", "value": "on"}, {"name": "REGION", "value": "eu"}]}}`,
+		},
+		{
+			"no env",
+			`{"spec": {"replicas": 1}}`,
+			SpecOverrides{Env: map[string]string{"REGION": "eu", "LOG": "info"}},
+			`{"spec": {"replicas": 1, "env": [{"name": "LOG", "value": "info"}, {"name": "REGION", "value": "eu"}]}}`,
+		},
+	}
+
+	for _, test := range tests {
+		var service map[string]interface{}
+		if err := json.Unmarshal([]byte(test.spec), &service); err != nil {
+			t.Fatalf("%s: invalid spec: %s", test.name, err.Error())
+		}
+		applyOverrides(service, test.overrides)
+
+		// compare the JSON documents, as the replicas override is an int
+		output, err := json.Marshal(service)
+		if err != nil {
+			t.Fatalf("%s: cannot marshal the service: %s", test.name, err.Error())
+		}
+		var got, expected interface{}
+		json.Unmarshal(output, &got)
+		json.Unmarshal([]byte(test.expected), &expected)
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("%s: expected %s, got %s", test.name, test.expected, output)
+		}
+	}
+}
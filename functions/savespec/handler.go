@@ -4,11 +4,18 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"os"
-	"strings"
+	"path"
 	"time"
 
+	"github.com/automium/automium-gateway/pkg/apikey"
+	"github.com/automium/automium-gateway/pkg/audit"
+	"github.com/automium/automium-gateway/pkg/logging"
+	"github.com/automium/automium-gateway/pkg/metrics"
+	"github.com/automium/automium-gateway/pkg/notify"
+	"github.com/automium/automium-gateway/pkg/reporting"
+	"github.com/automium/automium-gateway/pkg/specs"
+	"github.com/automium/automium-gateway/pkg/tracing"
 	types "github.com/automium/types/go/gateway"
 	"github.com/ghodss/yaml"
 	"github.com/satori/go.uuid"
@@ -18,6 +25,13 @@ import (
 	gitssh "gopkg.in/src-d/go-git.v4/plumbing/transport/ssh"
 )
 
+var recorder = metrics.New("savespec")
+var reporter = reporting.New("savespec")
+var logger = logging.New("savespec").TrackPhase(recorder.CurrentPhase)
+var requestTrace = tracing.FromEnv("savespec")
+var auditor = audit.New("savespec")
+var notifier = notify.New("savespec")
+
 func getAPISecret(secretName string) (secretBytes []byte, err error) {
 	root := "/var/openfaas/secrets/"
 
@@ -29,20 +43,45 @@ func getAPISecret(secretName string) (secretBytes []byte, err error) {
 //TODO: move to the shared types lib
 type GitSecret struct {
 	GitConfig types.GitConfig `json:"git"`
+	Specs     specs.Layout    `json:"specs"`
 }
 
 // Handle a serverless request
 func Handle(req []byte) string {
+	// The OpenFaaS gateway sets X-Call-Id on every call
+	requestID := logging.RequestID(os.Getenv("Http_X_Request_Id"), os.Getenv("Http_X_Call_Id"))
+	logger.Set(logging.FieldRequestID, requestID)
+	recorder.SetLogger(logger)
+	reporter.Tag(logging.FieldRequestID, requestID)
+	requestTrace.SetAttribute(logging.FieldRequestID, requestID)
+	recorder.OnPhase(requestTrace.Phase)
+	auditor.Request(requestID, req)
+	notifier.SetRequestID(requestID)
+	response := handle(req)
+	auditor.Record(nil)
+	requestTrace.End()
+	return logging.WithRequestID(response, requestID)
+}
+
+func handle(req []byte) string {
+
+	defer recorder.Finish(metrics.OutcomeSuccess)
 
 	key := os.Getenv("Http_X_Api_Key")
+	reporter.Tag("keyId", apikey.ID(key))
+	logger.Set(logging.FieldKeyID, apikey.ID(key))
+	requestTrace.SetAttribute(logging.FieldKeyID, apikey.ID(key))
+	auditor.Caller(apikey.ID(key), audit.SourceIP(os.Getenv("Http_X_Forwarded_For"), os.Getenv("Http_X_Real_Ip")))
+	phase := recorder.Phase(metrics.PhaseAuth)
 	err := validateInput(key)
+	phase.Done(err)
 	if err != nil {
-		log.Fatalf("[ERROR] Invalid input: %s", err.Error())
+		fatalf("Invalid input: %s", err.Error())
 	}
 
 	secretBytes, err := getAPISecret("GitConfig")
 	if err != nil {
-		log.Fatal(err)
+		fatalf("Cannot read secret: %s", err.Error())
 	}
 
 	var gitSecret GitSecret
@@ -51,95 +90,124 @@ func Handle(req []byte) string {
 	var inputData types.SaveSpec
 	err = json.Unmarshal(req, &inputData)
 	if err != nil {
-		log.Fatalf("[ERROR] Cannot parse incoming data: %s", err.Error())
+		fatalf("Cannot parse incoming data: %s", err.Error())
 	}
 	inputData.GitConfig = gitSecret.GitConfig
 
+	reporter.Tag("service", inputData.ServiceName)
+	logger.Set(logging.FieldService, inputData.ServiceName)
+	requestTrace.SetAttribute(logging.FieldService, inputData.ServiceName)
+	auditor.Target(inputData.ServiceName, "")
 	err = validateData(inputData)
 	if err != nil {
-		log.Fatalf("[ERROR] Invalid data: %s", err.Error())
+		fatalf("Invalid data: %s", err.Error())
+	}
+
+	err = gitSecret.Specs.Validate()
+	if err != nil {
+		fatalf("Invalid spec layout: %s", err.Error())
+	}
+
+	specPath, err := gitSecret.Specs.Path(inputData.ServiceName)
+	if err != nil {
+		fatalf("Invalid data: %s", err.Error())
 	}
 
 	// Generate a working directory
 	workingDirectoryPath := fmt.Sprintf("/home/app/gitrepo_%s", uuid.NewV4().String())
 	err = os.Mkdir(workingDirectoryPath, 0700)
 	if err != nil {
-		log.Fatalf("[ERROR] Cannot prepare temporary working dir: %s", err.Error())
+		fatalf("Cannot prepare temporary working dir: %s", err.Error())
 	}
 
 	// Parse SSH key from input
 	sshKey, err := ssh.ParsePrivateKey([]byte(inputData.GitConfig.RepositoryKey))
 	if err != nil {
 		cleanup(workingDirectoryPath)
-		log.Fatalf("[ERROR] Invalid SSH key: %s", err.Error())
+		fatalf("Invalid SSH key: %s", err.Error())
 	}
 
 	// Clone the repo
+	phase = recorder.Phase(metrics.PhaseGitClone)
 	repo, err := git.PlainClone(workingDirectoryPath, false, &git.CloneOptions{
 		Auth: returnSSHConfiguration(inputData.GitConfig.RepositoryUsername, sshKey),
 		URL:  inputData.GitConfig.RepositoryURL,
 	})
+	phase.Done(err)
 	if err != nil {
 		cleanup(workingDirectoryPath)
-		log.Fatalf("[ERROR] Cannot checkout Git repository: %s", err.Error())
+		fatalf("Cannot checkout Git repository: %s", err.Error())
 	}
 
 	service, err := json.Marshal(inputData.Service)
 	if err != nil {
 		cleanup(workingDirectoryPath)
-		log.Fatalf("[ERROR] Cannot parse service spec: %s", err.Error())
+		fatalf("Cannot parse service spec: %s", err.Error())
 	}
 
 	spec, err := yaml.JSONToYAML([]byte(service))
 	if err != nil {
-		log.Fatalf("[ERROR] Cannot convert service spec to yaml: %s", err.Error())
+		fatalf("Cannot convert service spec to yaml: %s", err.Error())
 	}
 
 	// Create or update the file
 	// TODO: improve logic
-	err = ioutil.WriteFile(fmt.Sprintf("%s/%s.yaml", workingDirectoryPath, strings.ToLower(inputData.ServiceName)), spec, 0600)
+	err = os.MkdirAll(path.Join(workingDirectoryPath, gitSecret.Specs.Dir()), 0700)
+	if err != nil {
+		cleanup(workingDirectoryPath)
+		fatalf("Cannot prepare spec directory: %s", err.Error())
+	}
+
+	err = ioutil.WriteFile(path.Join(workingDirectoryPath, specPath), spec, 0600)
 	if err != nil {
 		cleanup(workingDirectoryPath)
-		log.Fatalf("[ERROR] Cannot update file with spec: %s", err.Error())
+		fatalf("Cannot update file with spec: %s", err.Error())
 	}
 
 	// Retrieve the working tree
 	workingTree, err := repo.Worktree()
 	if err != nil {
 		cleanup(workingDirectoryPath)
-		log.Fatalf("[ERROR] Cannot move to working tree: %s", err.Error())
+		fatalf("Cannot move to working tree: %s", err.Error())
 	}
 
 	// Add the file
-	_, err = workingTree.Add(fmt.Sprintf("%s.yaml", strings.ToLower(inputData.ServiceName)))
+	_, err = workingTree.Add(specPath)
 	if err != nil {
 		cleanup(workingDirectoryPath)
-		log.Fatalf("[ERROR] Cannot add file to commit: %s", err.Error())
+		fatalf("Cannot add file to commit: %s", err.Error())
 	}
 
 	// Commit the change
-	_, err = workingTree.Commit(fmt.Sprintf("[AUTOMIUM] Update %s spec", inputData.ServiceName), &git.CommitOptions{Author: &object.Signature{
+	phase = recorder.Phase(metrics.PhaseGitCommit)
+	commit, err := workingTree.Commit(fmt.Sprintf("[AUTOMIUM] Update %s spec", inputData.ServiceName), &git.CommitOptions{Author: &object.Signature{
 		Name:  "Automium Bot",
 		Email: "automium-bot@automium.io",
 		When:  time.Now(),
 	}})
+	phase.Done(err)
 	if err != nil {
 		cleanup(workingDirectoryPath)
-		log.Fatalf("[ERROR] Cannot commit: %s", err.Error())
+		fatalf("Cannot commit: %s", err.Error())
 	}
+	auditor.Commit(commit.String())
 
 	// Push the change to the remote repository
+	phase = recorder.Phase(metrics.PhaseGitPush)
 	err = repo.Push(&git.PushOptions{
 		Auth: returnSSHConfiguration(inputData.GitConfig.RepositoryUsername, sshKey),
 	})
+	phase.Done(err)
 	if err != nil {
 		cleanup(workingDirectoryPath)
-		log.Fatalf("[ERROR] Cannot push: %s", err.Error())
+		fatalf("Cannot push: %s", err.Error())
 	}
 
 	// Cleanup...
 	cleanup(workingDirectoryPath)
 
+	notifier.Send(notify.Event{Type: notify.SpecSaved, Service: inputData.ServiceName, Commit: commit.String()})
+
 	// ...and we're good to go!
 	return fmt.Sprintf("{ \"status\": \"OK\"}")
 }
@@ -165,3 +233,14 @@ func returnSSHConfiguration(user string, signer ssh.Signer) *gitssh.PublicKeys {
 	obj.HostKeyCallback = ssh.InsecureIgnoreHostKey()
 	return obj
 }
+
+// fatalf reports, records, audits, traces and logs the failed request
+// before exiting
+func fatalf(format string, v ...interface{}) {
+	reporter.Reportf(format, v...)
+	recorder.Finish(metrics.OutcomeError)
+	auditor.Record(fmt.Errorf(format, v...))
+	requestTrace.Fail(fmt.Errorf(format, v...))
+	requestTrace.End()
+	logger.Fatalf(format, v...)
+}
@@ -0,0 +1,390 @@
+package function
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/automium/automium-gateway/pkg/apikey"
+	"github.com/automium/automium-gateway/pkg/audit"
+	"github.com/automium/automium-gateway/pkg/logging"
+	"github.com/automium/automium-gateway/pkg/metrics"
+	"github.com/automium/automium-gateway/pkg/reporting"
+	"github.com/automium/automium-gateway/pkg/specs"
+	"github.com/automium/automium-gateway/pkg/tracing"
+	types "github.com/automium/types/go/gateway"
+	v1beta1 "github.com/automium/types/go/v1beta1"
+	"github.com/ghodss/yaml"
+	"github.com/satori/go.uuid"
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	gitssh "gopkg.in/src-d/go-git.v4/plumbing/transport/ssh"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+const defaultNamespace = "default"
+
+//TODO: move to the shared types lib
+type GitSecret struct {
+	GitConfig types.GitConfig `json:"git"`
+	Specs     specs.Layout    `json:"specs"`
+}
+
+//TODO: move to the shared types lib
+type ScaleService struct {
+	ServiceName string          `json:"name"`
+	Namespace   string          `json:"namespace"`
+	Replicas    *int            `json:"replicas"`
+	SaveSpec    bool            `json:"saveSpec"`
+	Kubeconfig  string          `json:"-"`
+	GitConfig   types.GitConfig `json:"-"`
+	Specs       specs.Layout    `json:"-"`
+}
+
+//TODO: move to the shared types lib
+type ScaleResult struct {
+	ServiceName     string `json:"name"`
+	Namespace       string `json:"namespace"`
+	ReplicasBefore  int    `json:"replicasBefore"`
+	ReplicasAfter   int    `json:"replicasAfter"`
+	ResourceVersion string `json:"resourceVersion"`
+	Commit          string `json:"commit,omitempty"`
+}
+
+var recorder = metrics.New("scaleservice")
+var reporter = reporting.New("scaleservice")
+var logger = logging.New("scaleservice").TrackPhase(recorder.CurrentPhase)
+var requestTrace = tracing.FromEnv("scaleservice")
+var auditor = audit.New("scaleservice")
+
+func getAPISecret(secretName string) (secretBytes []byte, err error) {
+	root := "/var/openfaas/secrets/"
+
+	// read from the openfaas secrets folder
+	secretBytes, err = ioutil.ReadFile(root + secretName)
+	return secretBytes, err
+}
+
+// Handle a serverless request
+func Handle(req []byte) string {
+	// The OpenFaaS gateway sets X-Call-Id on every call
+	requestID := logging.RequestID(os.Getenv("Http_X_Request_Id"), os.Getenv("Http_X_Call_Id"))
+	logger.Set(logging.FieldRequestID, requestID)
+	recorder.SetLogger(logger)
+	reporter.Tag(logging.FieldRequestID, requestID)
+	requestTrace.SetAttribute(logging.FieldRequestID, requestID)
+	recorder.OnPhase(requestTrace.Phase)
+	auditor.Request(requestID, req)
+	response := handle(req)
+	auditor.Record(nil)
+	requestTrace.End()
+	return logging.WithRequestID(response, requestID)
+}
+
+func handle(req []byte) string {
+
+	defer recorder.Finish(metrics.OutcomeSuccess)
+
+	key := os.Getenv("Http_X_Api_Key")
+	reporter.Tag("keyId", apikey.ID(key))
+	logger.Set(logging.FieldKeyID, apikey.ID(key))
+	requestTrace.SetAttribute(logging.FieldKeyID, apikey.ID(key))
+	auditor.Caller(apikey.ID(key), audit.SourceIP(os.Getenv("Http_X_Forwarded_For"), os.Getenv("Http_X_Real_Ip")))
+	phase := recorder.Phase(metrics.PhaseAuth)
+	err := validateInput(key)
+	phase.Done(err)
+	if err != nil {
+		fatalf("Invalid input: %s", err.Error())
+	}
+
+	secretBytes, err := getAPISecret("KubeConfig")
+	if err != nil {
+		fatalf("Cannot read secret: %s", err.Error())
+	}
+
+	var kubeConfig types.KubernetesConfig
+	err = json.Unmarshal(secretBytes, &kubeConfig)
+
+	var inputData ScaleService
+	err = json.Unmarshal(req, &inputData)
+	if err != nil {
+		fatalf("Cannot handle input data: %s", err.Error())
+	}
+	inputData.Kubeconfig = kubeConfig.Kubeconfig
+	if inputData.Namespace == "" {
+		inputData.Namespace = defaultNamespace
+	}
+
+	if inputData.SaveSpec {
+		secretBytes, err = getAPISecret("GitConfig")
+		if err != nil {
+			fatalf("Cannot read secret: %s", err.Error())
+		}
+
+		var gitSecret GitSecret
+		err = json.Unmarshal(secretBytes, &gitSecret)
+		inputData.GitConfig = gitSecret.GitConfig
+		inputData.Specs = gitSecret.Specs
+	}
+
+	reporter.Tag("service", inputData.ServiceName)
+	logger.Set(logging.FieldService, inputData.ServiceName)
+	requestTrace.SetAttribute(logging.FieldService, inputData.ServiceName)
+	auditor.Target(inputData.ServiceName, inputData.Namespace)
+	err = validateData(inputData)
+	if err != nil {
+		fatalf("Invalid data: %s", err.Error())
+	}
+
+	config, err := clientcmd.RESTConfigFromKubeConfig([]byte(inputData.Kubeconfig))
+	if err != nil {
+		fatalf("Cannot create configuration from provided kubeconfig: %s", err.Error())
+	}
+
+	client, err := createRESTClient(config)
+	if err != nil {
+		fatalf("Cannot prepare the client: %s", err.Error())
+	}
+
+	var current = v1beta1.Service{}
+	phase = recorder.KubernetesPhase("GET", "services", inputData.ServiceName)
+	err = client.Get().Resource("services").Name(inputData.ServiceName).Namespace(inputData.Namespace).Do().Into(&current)
+	phase.Done(err)
+	if err != nil {
+		fatalf("Cannot get service: %s", err.Error())
+	}
+
+	// Only touch the replicas; the resource version makes the patch fail if
+	// someone else updated the service in the meantime
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{"resourceVersion": current.ObjectMeta.ResourceVersion},
+		"spec":     map[string]interface{}{"replicas": *inputData.Replicas},
+	})
+	if err != nil {
+		fatalf("Cannot prepare patch: %s", err.Error())
+	}
+
+	var result = v1beta1.Service{}
+	phase = recorder.KubernetesPhase("PATCH", "services", inputData.ServiceName)
+	err = client.Patch(k8stypes.MergePatchType).Resource("services").Name(inputData.ServiceName).Namespace(inputData.Namespace).Body(patch).Do().Into(&result)
+	phase.Done(err)
+	if err != nil {
+		fatalf("Cannot scale service: %s", err.Error())
+	}
+
+	output := ScaleResult{
+		ServiceName:     inputData.ServiceName,
+		Namespace:       inputData.Namespace,
+		ReplicasBefore:  int(current.Spec.Replicas),
+		ReplicasAfter:   int(result.Spec.Replicas),
+		ResourceVersion: result.ObjectMeta.ResourceVersion,
+	}
+	auditor.ResourceVersion(output.ResourceVersion)
+
+	if inputData.SaveSpec {
+		output.Commit, err = saveReplicas(inputData)
+		if err != nil {
+			fatalf("Service scaled to %d replicas but the spec was not saved: %s", output.ReplicasAfter, err.Error())
+		}
+		auditor.Commit(output.Commit)
+	}
+
+	outputJSON, err := json.Marshal(output)
+	if err != nil {
+		fatalf("Cannot marshal output: %s", err.Error())
+	}
+
+	return string(outputJSON)
+}
+
+// saveReplicas mirrors the new replica count into the service spec stored in
+// the Git repository, the same way savespec commits a spec
+func saveReplicas(input ScaleService) (string, error) {
+	// Generate a working directory
+	workingDirectoryPath := fmt.Sprintf("/home/app/gitrepo_%s", uuid.NewV4().String())
+	err := os.Mkdir(workingDirectoryPath, 0700)
+	if err != nil {
+		return "", fmt.Errorf("cannot prepare temporary working dir: %s", err.Error())
+	}
+	defer cleanup(workingDirectoryPath)
+
+	// Parse SSH key from input
+	sshKey, err := ssh.ParsePrivateKey([]byte(input.GitConfig.RepositoryKey))
+	if err != nil {
+		return "", fmt.Errorf("invalid SSH key: %s", err.Error())
+	}
+
+	// Clone the repo
+	phase := recorder.Phase(metrics.PhaseGitClone)
+	repo, err := git.PlainClone(workingDirectoryPath, false, &git.CloneOptions{
+		Auth: returnSSHConfiguration(input.GitConfig.RepositoryUsername, sshKey),
+		URL:  input.GitConfig.RepositoryURL,
+	})
+	phase.Done(err)
+	if err != nil {
+		return "", fmt.Errorf("cannot checkout Git repository: %s", err.Error())
+	}
+
+	specFileName, err := input.Specs.Path(input.ServiceName)
+	if err != nil {
+		return "", err
+	}
+	specFilePath := fmt.Sprintf("%s/%s", workingDirectoryPath, specFileName)
+
+	content, err := ioutil.ReadFile(specFilePath)
+	if err != nil {
+		return "", fmt.Errorf("cannot read spec file: %s", err.Error())
+	}
+
+	// Work on a generic document so fields this function does not know
+	// about are preserved
+	specJSON, err := yaml.YAMLToJSON(content)
+	if err != nil {
+		return "", fmt.Errorf("cannot parse spec file: %s", err.Error())
+	}
+
+	var spec map[string]interface{}
+	err = json.Unmarshal(specJSON, &spec)
+	if err != nil {
+		return "", fmt.Errorf("cannot parse spec file: %s", err.Error())
+	}
+
+	serviceSpec, ok := spec["spec"].(map[string]interface{})
+	if !ok {
+		serviceSpec = map[string]interface{}{}
+		spec["spec"] = serviceSpec
+	}
+	serviceSpec["replicas"] = *input.Replicas
+
+	specJSON, err = json.Marshal(spec)
+	if err != nil {
+		return "", fmt.Errorf("cannot parse service spec: %s", err.Error())
+	}
+
+	content, err = yaml.JSONToYAML(specJSON)
+	if err != nil {
+		return "", fmt.Errorf("cannot convert service spec to yaml: %s", err.Error())
+	}
+
+	err = ioutil.WriteFile(specFilePath, content, 0600)
+	if err != nil {
+		return "", fmt.Errorf("cannot update file with spec: %s", err.Error())
+	}
+
+	// Retrieve the working tree
+	workingTree, err := repo.Worktree()
+	if err != nil {
+		return "", fmt.Errorf("cannot move to working tree: %s", err.Error())
+	}
+
+	// Add the file
+	_, err = workingTree.Add(specFileName)
+	if err != nil {
+		return "", fmt.Errorf("cannot add file to commit: %s", err.Error())
+	}
+
+	// Commit the change
+	phase = recorder.Phase(metrics.PhaseGitCommit)
+	commit, err := workingTree.Commit(fmt.Sprintf("[AUTOMIUM] Scale %s to %d replicas", input.ServiceName, *input.Replicas), &git.CommitOptions{Author: &object.Signature{
+		Name:  "Automium Bot",
+		Email: "automium-bot@automium.io",
+		When:  time.Now(),
+	}})
+	phase.Done(err)
+	if err != nil {
+		return "", fmt.Errorf("cannot commit: %s", err.Error())
+	}
+
+	// Push the change to the remote repository
+	phase = recorder.Phase(metrics.PhaseGitPush)
+	err = repo.Push(&git.PushOptions{
+		Auth: returnSSHConfiguration(input.GitConfig.RepositoryUsername, sshKey),
+	})
+	phase.Done(err)
+	if err != nil {
+		return "", fmt.Errorf("cannot push: %s", err.Error())
+	}
+
+	return commit.String(), nil
+}
+
+func createRESTClient(config *rest.Config) (*rest.RESTClient, error) {
+	v1beta1.AddToScheme(scheme.Scheme)
+
+	crdConfig := *config
+	crdConfig.ContentConfig.GroupVersion = &schema.GroupVersion{Group: v1beta1.GroupName, Version: v1beta1.GroupVersion}
+	crdConfig.APIPath = "/apis"
+	crdConfig.NegotiatedSerializer = serializer.DirectCodecFactory{CodecFactory: scheme.Codecs}
+	crdConfig.UserAgent = rest.DefaultKubernetesUserAgent()
+
+	rc, err := rest.UnversionedRESTClientFor(&crdConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	return rc, nil
+}
+
+func validateInput(input string) error {
+	//log.Printf("request with %s key", input)
+	// TODO: validation
+	return nil
+}
+
+func validateData(input ScaleService) error {
+	if input.ServiceName == "" {
+		return fmt.Errorf("missing service name")
+	}
+
+	if input.Replicas == nil {
+		return fmt.Errorf("missing replicas")
+	}
+
+	if *input.Replicas < 0 {
+		return fmt.Errorf("replicas must not be negative")
+	}
+
+	if input.SaveSpec {
+		err := input.Specs.Validate()
+		if err != nil {
+			return fmt.Errorf("invalid spec layout: %s", err.Error())
+		}
+		err = specs.ValidateName(input.ServiceName)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func cleanup(path string) {
+	os.RemoveAll(path)
+}
+
+func returnSSHConfiguration(user string, signer ssh.Signer) *gitssh.PublicKeys {
+	obj := &gitssh.PublicKeys{User: user, Signer: signer}
+	// TODO: find a way to check SSH host keys
+	obj.HostKeyCallback = ssh.InsecureIgnoreHostKey()
+	return obj
+}
+
+// fatalf reports, records, audits, traces and logs the failed request
+// before exiting
+func fatalf(format string, v ...interface{}) {
+	reporter.Reportf(format, v...)
+	recorder.Finish(metrics.OutcomeError)
+	auditor.Record(fmt.Errorf(format, v...))
+	requestTrace.Fail(fmt.Errorf(format, v...))
+	requestTrace.End()
+	logger.Fatalf(format, v...)
+}
@@ -0,0 +1,281 @@
+package function
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/automium/automium-gateway/pkg/apikey"
+	"github.com/automium/automium-gateway/pkg/logging"
+	"github.com/automium/automium-gateway/pkg/metrics"
+	"github.com/automium/automium-gateway/pkg/reporting"
+	"github.com/automium/automium-gateway/pkg/tracing"
+	types "github.com/automium/types/go/gateway"
+	v1beta1 "github.com/automium/types/go/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+const (
+	defaultNamespace = "default"
+	serviceLabel     = "app"
+)
+
+//TODO: move to the shared types lib
+type ServiceEvents struct {
+	ServiceName   string `json:"name"`
+	Namespace     string `json:"namespace"`
+	LabelSelector string `json:"labelSelector"`
+	Kubeconfig    string `json:"-"`
+}
+
+//TODO: move to the shared types lib
+type ServiceEvent struct {
+	Kind           string    `json:"kind"`
+	Name           string    `json:"name"`
+	Type           string    `json:"type"`
+	Reason         string    `json:"reason"`
+	Message        string    `json:"message"`
+	Source         string    `json:"source"`
+	Count          int32     `json:"count"`
+	FirstTimestamp time.Time `json:"firstTimestamp"`
+	LastTimestamp  time.Time `json:"lastTimestamp"`
+}
+
+var recorder = metrics.New("serviceevents")
+var reporter = reporting.New("serviceevents")
+var logger = logging.New("serviceevents").TrackPhase(recorder.CurrentPhase)
+var requestTrace = tracing.FromEnv("serviceevents")
+
+func getAPISecret(secretName string) (secretBytes []byte, err error) {
+	root := "/var/openfaas/secrets/"
+
+	// read from the openfaas secrets folder
+	secretBytes, err = ioutil.ReadFile(root + secretName)
+	return secretBytes, err
+}
+
+// Handle a serverless request
+func Handle(req []byte) string {
+	// The OpenFaaS gateway sets X-Call-Id on every call
+	requestID := logging.RequestID(os.Getenv("Http_X_Request_Id"), os.Getenv("Http_X_Call_Id"))
+	logger.Set(logging.FieldRequestID, requestID)
+	recorder.SetLogger(logger)
+	reporter.Tag(logging.FieldRequestID, requestID)
+	requestTrace.SetAttribute(logging.FieldRequestID, requestID)
+	recorder.OnPhase(requestTrace.Phase)
+	response := handle(req)
+	requestTrace.End()
+	return logging.WithRequestID(response, requestID)
+}
+
+func handle(req []byte) string {
+
+	defer recorder.Finish(metrics.OutcomeSuccess)
+
+	key := os.Getenv("Http_X_Api_Key")
+	reporter.Tag("keyId", apikey.ID(key))
+	logger.Set(logging.FieldKeyID, apikey.ID(key))
+	requestTrace.SetAttribute(logging.FieldKeyID, apikey.ID(key))
+	phase := recorder.Phase(metrics.PhaseAuth)
+	err := validateInput(key)
+	phase.Done(err)
+	if err != nil {
+		fatalf("Invalid input: %s", err.Error())
+	}
+
+	secretBytes, err := getAPISecret("KubeConfig")
+	if err != nil {
+		fatalf("Cannot read secret: %s", err.Error())
+	}
+
+	var kubeConfig types.KubernetesConfig
+	err = json.Unmarshal(secretBytes, &kubeConfig)
+
+	var inputData ServiceEvents
+	err = json.Unmarshal(req, &inputData)
+	if err != nil {
+		fatalf("Cannot handle input data: %s", err.Error())
+	}
+	inputData.Kubeconfig = kubeConfig.Kubeconfig
+	if inputData.Namespace == "" {
+		inputData.Namespace = defaultNamespace
+	}
+	if inputData.LabelSelector == "" {
+		inputData.LabelSelector = labels.Set{serviceLabel: inputData.ServiceName}.String()
+	}
+
+	reporter.Tag("service", inputData.ServiceName)
+	logger.Set(logging.FieldService, inputData.ServiceName)
+	requestTrace.SetAttribute(logging.FieldService, inputData.ServiceName)
+	err = validateData(inputData)
+	if err != nil {
+		fatalf("Invalid data: %s", err.Error())
+	}
+
+	config, err := clientcmd.RESTConfigFromKubeConfig([]byte(inputData.Kubeconfig))
+	if err != nil {
+		fatalf("Cannot create configuration from provided kubeconfig: %s", err.Error())
+	}
+
+	// create the clientset
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		fatalf("Cannot prepare the client: %s", err.Error())
+	}
+
+	phase = recorder.KubernetesPhase("LIST", "pods", inputData.ServiceName)
+	pods, err := client.CoreV1().Pods(inputData.Namespace).List(metav1.ListOptions{LabelSelector: inputData.LabelSelector})
+	phase.Done(err)
+	if err != nil {
+		fatalf("Cannot get pods list %s", err.Error())
+	}
+
+	// Ask only for the events of the Service and of its pods, instead of
+	// every event of the namespace
+	phase = recorder.KubernetesPhase("LIST", "events", inputData.ServiceName)
+	events, err := listEvents(client, inputData.Namespace, "Service", inputData.ServiceName)
+	phase.Done(err)
+	if err != nil {
+		fatalf("Cannot get events list %s", err.Error())
+	}
+
+	var related = []corev1.Event{}
+	for _, event := range events {
+		if isServiceEvent(event, inputData.ServiceName) {
+			related = append(related, event)
+		}
+	}
+
+	for _, pod := range pods.Items {
+		phase = recorder.KubernetesPhase("LIST", "events", inputData.ServiceName)
+		events, err = listEvents(client, inputData.Namespace, "Pod", pod.Name)
+		phase.Done(err)
+		if err != nil {
+			fatalf("Cannot get events list %s", err.Error())
+		}
+		related = append(related, events...)
+	}
+
+	eventsJSON, err := json.Marshal(map[string]interface{}{"events": mergeEvents(related)})
+	if err != nil {
+		fatalf("Cannot marshal output: %s", err.Error())
+	}
+
+	return string(eventsJSON)
+}
+
+// isServiceEvent tells if the event involves the Automium Service, and not a
+// core Service with the same name
+func isServiceEvent(event corev1.Event, serviceName string) bool {
+	return event.InvolvedObject.Kind == "Service" &&
+		event.InvolvedObject.Name == serviceName &&
+		strings.HasPrefix(event.InvolvedObject.APIVersion, v1beta1.GroupName+"/")
+}
+
+// listEvents lists the events involving an object, filtered by the API
+// server
+func listEvents(client *kubernetes.Clientset, namespace string, kind string, name string) ([]corev1.Event, error) {
+	selector := fields.Set{"involvedObject.kind": kind, "involvedObject.name": name}.AsSelector().String()
+	events, err := client.CoreV1().Events(namespace).List(metav1.ListOptions{FieldSelector: selector})
+	if err != nil {
+		return nil, err
+	}
+	return events.Items, nil
+}
+
+// mergeEvents de-duplicates the events reported more than once for the same
+// object, summing their counts, and sorts them by the time they last happened
+func mergeEvents(events []corev1.Event) []ServiceEvent {
+	var merged = []ServiceEvent{}
+	index := map[string]int{}
+
+	for _, event := range events {
+		first, last := eventTimes(event)
+		count := event.Count
+		if count == 0 {
+			count = 1
+		}
+
+		key := strings.Join([]string{event.InvolvedObject.Kind, event.InvolvedObject.Name, event.Type, event.Reason, event.Message}, "/")
+		if i, ok := index[key]; ok {
+			merged[i].Count += count
+			if first.Before(merged[i].FirstTimestamp) {
+				merged[i].FirstTimestamp = first
+			}
+			if last.After(merged[i].LastTimestamp) {
+				merged[i].LastTimestamp = last
+			}
+			continue
+		}
+
+		index[key] = len(merged)
+		merged = append(merged, ServiceEvent{
+			Kind:           event.InvolvedObject.Kind,
+			Name:           event.InvolvedObject.Name,
+			Type:           event.Type,
+			Reason:         event.Reason,
+			Message:        event.Message,
+			Source:         event.Source.Component,
+			Count:          count,
+			FirstTimestamp: first,
+			LastTimestamp:  last,
+		})
+	}
+
+	sort.SliceStable(merged, func(i, j int) bool {
+		return merged[i].LastTimestamp.Before(merged[j].LastTimestamp)
+	})
+	return merged
+}
+
+// eventTimes returns when the event happened first and last, falling back to
+// the event time for the events that do not set the timestamps
+func eventTimes(event corev1.Event) (time.Time, time.Time) {
+	first := event.FirstTimestamp.Time
+	last := event.LastTimestamp.Time
+	if first.IsZero() {
+		first = event.EventTime.Time
+	}
+	if last.IsZero() {
+		last = first
+	}
+	return first, last
+}
+
+func validateInput(input string) error {
+	//log.Printf("request with %s key", input)
+	// TODO: validation
+	return nil
+}
+
+func validateData(input ServiceEvents) error {
+	if input.ServiceName == "" {
+		return fmt.Errorf("missing service name")
+	}
+
+	_, err := labels.Parse(input.LabelSelector)
+	if err != nil {
+		return fmt.Errorf("invalid label selector: %s", err.Error())
+	}
+
+	return nil
+}
+
+// fatalf reports, records, traces and logs the failed request before exiting
+func fatalf(format string, v ...interface{}) {
+	reporter.Reportf(format, v...)
+	recorder.Finish(metrics.OutcomeError)
+	requestTrace.Fail(fmt.Errorf(format, v...))
+	requestTrace.End()
+	logger.Fatalf(format, v...)
+}
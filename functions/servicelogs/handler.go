@@ -1,21 +1,101 @@
 package function
 
 import (
+	"bufio"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
+	"net/http"
 	"os"
+	"regexp"
+	"sort"
 	"strings"
+	"time"
 
+	"github.com/automium/automium-gateway/pkg/apikey"
+	"github.com/automium/automium-gateway/pkg/logging"
+	"github.com/automium/automium-gateway/pkg/metrics"
+	"github.com/automium/automium-gateway/pkg/reporting"
+	"github.com/automium/automium-gateway/pkg/tracing"
 	types "github.com/automium/types/go/gateway"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/clientcmd"
 )
 
+const (
+	defaultNamespace = "default"
+	serviceLabel     = "app"
+	maxLineSize      = 1024 * 1024
+
+	// Without explicit options only the end of the logs is returned, so a
+	// long running pod cannot make the function run out of memory
+	defaultTailLines  = 1000
+	defaultLimitBytes = 1024 * 1024
+
+	defaultMaxFollowDuration = 10 * time.Minute
+)
+
+// logLevels are sorted by severity
+var logLevels = []string{"trace", "debug", "info", "warn", "error", "fatal"}
+
+//TODO: move to the shared types lib
+type ServiceLogs struct {
+	types.ServiceLogs
+	Namespace     string `json:"namespace"`
+	LabelSelector string `json:"labelSelector"`
+	Pod           string `json:"pod"`
+	Container     string `json:"container"`
+	AllContainers bool   `json:"allContainers"`
+	TailLines     *int64 `json:"tailLines"`
+	SinceSeconds  *int64 `json:"sinceSeconds"`
+	SinceTime     string `json:"sinceTime"`
+	LimitBytes    *int64 `json:"limitBytes"`
+	Previous      bool   `json:"previous"`
+	Timestamps    bool   `json:"timestamps"`
+
+	Follow             bool `json:"follow"`
+	MaxDurationSeconds int  `json:"maxDurationSeconds"`
+
+	Grep  string `json:"grep"`
+	Regex string `json:"regex"`
+	Level string `json:"level"`
+}
+
+//TODO: move to the shared types lib
+type ServiceLogsResult struct {
+	Pods    []string  `json:"pods"`
+	Lines   []LogLine `json:"lines"`
+	Message string    `json:"message,omitempty"`
+}
+
+// LogLine is a log line tagged with the pod and container it comes from
+type LogLine struct {
+	Pod       string `json:"pod"`
+	Container string `json:"container"`
+	Time      string `json:"time,omitempty"`
+	Message   string `json:"message"`
+
+	// Set when the message is a JSON object
+	Level  string                 `json:"level,omitempty"`
+	Msg    string                 `json:"msg,omitempty"`
+	TS     interface{}            `json:"ts,omitempty"`
+	Fields map[string]interface{} `json:"fields,omitempty"`
+
+	timestamp time.Time
+}
+
+// LineFilter selects the log lines returned to the caller
+type LineFilter struct {
+	Grep  string
+	Regex *regexp.Regexp
+	Level int
+}
+
 func getAPISecret(secretName string) (secretBytes []byte, err error) {
 	root := "/var/openfaas/secrets/"
 
@@ -25,79 +105,486 @@ func getAPISecret(secretName string) (secretBytes []byte, err error) {
 }
 
 // Handle a serverless request
-func Handle(req []byte) string {
+func Handle(w http.ResponseWriter, r *http.Request) {
+	metrics.Instrument("servicelogs", logging.Instrument("servicelogs", reporting.Instrument("servicelogs", tracing.Instrument("servicelogs", handle))))(w, r)
+}
+
+func handle(w http.ResponseWriter, r *http.Request) {
+
+	recorder := metrics.FromRequest(r)
+	logger := logging.FromRequest(r).TrackPhase(recorder.CurrentPhase)
+	recorder.SetLogger(logger)
+	reporter := reporting.FromRequest(r)
+	reporter.Tag(logging.FieldRequestID, w.Header().Get(logging.RequestIDHeader))
+	requestTrace := tracing.FromRequest(r)
+	requestTrace.SetAttribute(logging.FieldRequestID, w.Header().Get(logging.RequestIDHeader))
+	requestTrace.SetAttribute(logging.FieldKeyID, apikey.ID(r.Header.Get("X-Api-Key")))
+	recorder.OnPhase(requestTrace.Phase)
 
-	key := os.Getenv("Http_x_api_key")
+	key := r.Header.Get("X-Api-Key")
+	phase := recorder.Phase(metrics.PhaseAuth)
 	err := validateInput(key)
+	phase.Done(err)
 	if err != nil {
-		log.Fatalf("[ERROR] Invalid input: %s", err.Error())
+		httpError(w, r, http.StatusUnauthorized, "Invalid input: %s", err.Error())
+		return
 	}
 
 	secretBytes, err := getAPISecret("KubeConfig")
 	if err != nil {
-		log.Fatal(err)
+		httpError(w, r, http.StatusInternalServerError, "Cannot read kubeconfig: %s", err.Error())
+		return
 	}
 
 	var kubeConfig types.KubernetesConfig
 	err = json.Unmarshal(secretBytes, &kubeConfig)
 
-	var inputData types.ServiceLogs
+	req, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		httpError(w, r, http.StatusBadRequest, "Cannot read input data: %s", err.Error())
+		return
+	}
+
+	var inputData ServiceLogs
 	err = json.Unmarshal(req, &inputData)
 	if err != nil {
-		log.Fatalf("[ERROR] Cannot handle input data: %s", err.Error())
+		httpError(w, r, http.StatusBadRequest, "Cannot handle input data: %s", err.Error())
+		return
 	}
 	inputData.Kubeconfig = kubeConfig.Kubeconfig
+	if inputData.Namespace == "" {
+		inputData.Namespace = defaultNamespace
+	}
+	if inputData.LabelSelector == "" {
+		inputData.LabelSelector = labels.Set{serviceLabel: inputData.ServiceName}.String()
+	}
 
+	reporter.Tag("service", inputData.ServiceName)
+	logger.Set(logging.FieldService, inputData.ServiceName)
+	requestTrace.SetAttribute(logging.FieldService, inputData.ServiceName)
 	err = validateData(inputData)
 	if err != nil {
-		log.Fatalf("[ERROR] Invalid data: %s", err.Error())
+		httpError(w, r, http.StatusBadRequest, "Invalid data: %s", err.Error())
+		return
 	}
 
 	config, err := clientcmd.RESTConfigFromKubeConfig([]byte(inputData.Kubeconfig))
 	if err != nil {
-		log.Fatalf("[ERROR] Cannot create configuration from provided kubeconfig: %s", err.Error())
+		httpError(w, r, http.StatusInternalServerError, "Cannot create configuration from provided kubeconfig: %s", err.Error())
+		return
 	}
 
 	// create the clientset
 	client, err := kubernetes.NewForConfig(config)
 	if err != nil {
-		log.Fatalf("[ERROR] Cannot prepare the client: %s", err.Error())
+		httpError(w, r, http.StatusInternalServerError, "Cannot prepare the client: %s", err.Error())
+		return
+	}
+
+	phase = recorder.KubernetesPhase("LIST", "pods", inputData.ServiceName)
+	pods, err := client.CoreV1().Pods(inputData.Namespace).List(metav1.ListOptions{LabelSelector: inputData.LabelSelector})
+	phase.Done(err)
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "Cannot get pods list %s", err.Error())
+		return
+	}
+
+	selected := selectPods(pods.Items, inputData)
+	result := ServiceLogsResult{Pods: podNames(pods.Items), Lines: []LogLine{}}
+	if len(selected) == 0 {
+		if inputData.Pod != "" {
+			httpError(w, r, http.StatusNotFound, "Pod %s does not belong to service %s", inputData.Pod, inputData.ServiceName)
+			return
+		}
+		result.Message = "Service logs not found"
+		writeResult(w, r, result)
+		return
+	}
+
+	// already checked by validateData
+	filter, _ := newLineFilter(inputData)
+
+	if inputData.Follow {
+		followLogs(w, r, client, selected, inputData, filter)
+		return
+	}
+
+	var lines = []LogLine{}
+	for _, pod := range selected {
+		for _, container := range podContainers(pod, inputData) {
+			phase = recorder.KubernetesPhase("GET", "pods/log", inputData.ServiceName)
+			containerLines, err := readLogs(client, pod, podLogOptions(inputData, container), filter, inputData.Timestamps)
+			phase.Done(err)
+			if err != nil {
+				httpError(w, r, http.StatusInternalServerError, "Cannot get service logs for pod %s container %s. %s", pod.Name, container, err.Error())
+				return
+			}
+			lines = append(lines, containerLines...)
+		}
+	}
+
+	// Interleave the lines of every pod and container by timestamp, keeping
+	// the original order for lines logged at the same time
+	sort.SliceStable(lines, func(i, j int) bool {
+		return lines[i].timestamp.Before(lines[j].timestamp)
+	})
+
+	result.Lines = lines
+	writeResult(w, r, result)
+}
+
+// followLogs streams the lines of every selected container as they arrive,
+// until the containers stop, the client disconnects or the follow duration
+// elapses
+func followLogs(w http.ResponseWriter, r *http.Request, client *kubernetes.Clientset, pods []corev1.Pod, input ServiceLogs, filter LineFilter) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		httpError(w, r, http.StatusInternalServerError, "Streaming is not supported")
+		return
+	}
+
+	recorder := metrics.FromRequest(r)
+	logger := logging.FromRequest(r)
+
+	done := make(chan struct{})
+	defer close(done)
+
+	lines := make(chan LogLine)
+	finished := make(chan struct{})
+	running := 0
+	for _, pod := range pods {
+		for _, container := range podContainers(pod, input) {
+			podLogOpts := podLogOptions(input, container)
+			phase := recorder.KubernetesPhase("GET", "pods/log", input.ServiceName)
+			readCloser, err := client.CoreV1().Pods(pod.Namespace).GetLogs(pod.Name, &podLogOpts).Stream()
+			phase.Done(err)
+			if err != nil {
+				httpError(w, r, http.StatusInternalServerError, "Cannot get service logs for pod %s container %s. %s", pod.Name, container, err.Error())
+				return
+			}
+			// Closing the stream also unblocks the goroutine reading it
+			defer readCloser.Close()
+
+			go scanLines(pod.Name, container, readCloser, filter, input.Timestamps, lines, finished, done)
+			running++
+		}
+	}
+
+	sse := strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+	if sse {
+		w.Header().Set("Content-Type", "text/event-stream")
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	timeout := time.NewTimer(followDuration(input))
+	defer timeout.Stop()
+
+	for running > 0 {
+		select {
+		case line := <-lines:
+			err := writeLine(w, sse, line)
+			if err != nil {
+				logger.Errorf("Cannot write service logs: %s", err.Error())
+				return
+			}
+			flusher.Flush()
+		case <-finished:
+			running--
+		case <-timeout.C:
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func scanLines(pod string, container string, reader io.Reader, filter LineFilter, timestamps bool, lines chan<- LogLine, finished chan<- struct{}, done <-chan struct{}) {
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), maxLineSize)
+	for scanner.Scan() {
+		line := parseLine(pod, container, scanner.Text(), timestamps)
+		if !filter.Match(line) {
+			continue
+		}
+
+		select {
+		case lines <- line:
+		case <-done:
+			return
+		}
 	}
 
-	pods, err := client.CoreV1().Pods("default").List(metav1.ListOptions{})
+	select {
+	case finished <- struct{}{}:
+	case <-done:
+	}
+}
+
+func writeLine(w io.Writer, sse bool, line LogLine) error {
+	lineJSON, err := json.Marshal(line)
 	if err != nil {
-		log.Fatalf("[ERROR] Cannot get jobs list %s", err.Error())
+		return err
+	}
+
+	if sse {
+		_, err = fmt.Fprintf(w, "data: %s\n\n", lineJSON)
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", lineJSON)
+	return err
+}
+
+// followDuration returns how long to follow the logs: the requested duration,
+// capped by the max_follow_duration of the function
+func followDuration(input ServiceLogs) time.Duration {
+	maxDuration, err := time.ParseDuration(os.Getenv("max_follow_duration"))
+	if err != nil || maxDuration <= 0 {
+		maxDuration = defaultMaxFollowDuration
+	}
+
+	duration := time.Duration(input.MaxDurationSeconds) * time.Second
+	if duration <= 0 || duration > maxDuration {
+		return maxDuration
 	}
-	var pod *corev1.Pod
-	for _, p := range pods.Items {
-		if strings.HasPrefix(p.Name, inputData.ServiceName) {
-			pod = &p
+	return duration
+}
+
+// selectPods returns the pods to read the logs from: the requested pod only,
+// or every pod of the service running the requested container
+func selectPods(pods []corev1.Pod, input ServiceLogs) []corev1.Pod {
+	var selected = []corev1.Pod{}
+	for _, pod := range pods {
+		if input.Pod != "" && pod.Name != input.Pod {
+			continue
+		}
+		if len(podContainers(pod, input)) == 0 {
+			continue
+		}
+		selected = append(selected, pod)
+	}
+
+	sort.Slice(selected, func(i, j int) bool {
+		return selected[i].Name < selected[j].Name
+	})
+	return selected
+}
+
+// podContainers returns the containers of the pod to read the logs from,
+// defaulting to the first container as kubectl does
+func podContainers(pod corev1.Pod, input ServiceLogs) []string {
+	var containers = []string{}
+	for _, container := range pod.Spec.Containers {
+		if input.Container != "" && container.Name != input.Container {
+			continue
+		}
+		containers = append(containers, container.Name)
+		if input.Container == "" && !input.AllContainers {
 			break
 		}
 	}
-	if pod == nil {
-		return fmt.Sprint("{ \"logs\": \"Service logs not found\"}")
+	return containers
+}
+
+// podLogOptions maps the request onto the pod log options of a container
+func podLogOptions(input ServiceLogs, container string) corev1.PodLogOptions {
+	// Timestamps are always requested, they are needed to merge the lines
+	podLogOpts := corev1.PodLogOptions{
+		Container:    container,
+		Follow:       input.Follow,
+		Timestamps:   true,
+		Previous:     input.Previous,
+		TailLines:    input.TailLines,
+		SinceSeconds: input.SinceSeconds,
+		LimitBytes:   input.LimitBytes,
+	}
+
+	if input.SinceTime != "" {
+		// already checked by validateData
+		sinceTime, _ := time.Parse(time.RFC3339, input.SinceTime)
+		podLogOpts.SinceTime = &metav1.Time{Time: sinceTime}
+	}
+
+	if podLogOpts.TailLines == nil && podLogOpts.SinceSeconds == nil && podLogOpts.SinceTime == nil {
+		tailLines := int64(defaultTailLines)
+		podLogOpts.TailLines = &tailLines
+	}
+
+	// A followed stream is bounded by its duration instead
+	if podLogOpts.LimitBytes == nil && !input.Follow {
+		limitBytes := int64(defaultLimitBytes)
+		podLogOpts.LimitBytes = &limitBytes
 	}
 
-	podLogOpts := corev1.PodLogOptions{}
-	request := client.CoreV1().Pods("default").GetLogs(pod.Name, &podLogOpts)
+	return podLogOpts
+}
+
+func readLogs(client *kubernetes.Clientset, pod corev1.Pod, podLogOpts corev1.PodLogOptions, filter LineFilter, timestamps bool) ([]LogLine, error) {
+	request := client.CoreV1().Pods(pod.Namespace).GetLogs(pod.Name, &podLogOpts)
 
 	readCloser, err := request.Stream()
 	if err != nil {
-		log.Fatalf("[ERROR] Cannot get service logs for pod %s. %s", pod.Name, err.Error())
+		return nil, err
 	}
-
 	defer readCloser.Close()
-	out, err := ioutil.ReadAll(readCloser)
+
+	var lines = []LogLine{}
+	scanner := bufio.NewScanner(readCloser)
+	scanner.Buffer(make([]byte, 64*1024), maxLineSize)
+	for scanner.Scan() {
+		line := parseLine(pod.Name, podLogOpts.Container, scanner.Text(), timestamps)
+		if filter.Match(line) {
+			lines = append(lines, line)
+		}
+	}
+	return lines, scanner.Err()
+}
+
+// parseLine splits the timestamp added by Kubernetes from the log message,
+// and exposes the fields of JSON formatted messages
+func parseLine(pod string, container string, text string, timestamps bool) LogLine {
+	line := LogLine{Pod: pod, Container: container, Message: text}
+
+	parts := strings.SplitN(text, " ", 2)
+	if len(parts) == 2 {
+		timestamp, err := time.Parse(time.RFC3339Nano, parts[0])
+		if err == nil {
+			line.timestamp = timestamp
+			line.Message = parts[1]
+			if timestamps {
+				line.Time = parts[0]
+			}
+		}
+	}
+
+	if !strings.HasPrefix(strings.TrimSpace(line.Message), "{") {
+		return line
+	}
+
+	var fields map[string]interface{}
+	err := json.Unmarshal([]byte(line.Message), &fields)
 	if err != nil {
-		log.Fatalf("[ERROR] Cannot read service logs %s", err.Error())
+		return line
+	}
+
+	line.Fields = fields
+	line.Level = normalizeLevel(stringField(fields, "level", "lvl", "severity"))
+	line.Msg = stringField(fields, "msg", "message")
+	for _, key := range []string{"ts", "time", "timestamp"} {
+		if value, ok := fields[key]; ok {
+			line.TS = value
+			break
+		}
+	}
+	return line
+}
+
+// stringField returns the first of the keys holding a string
+func stringField(fields map[string]interface{}, keys ...string) string {
+	for _, key := range keys {
+		if value, ok := fields[key].(string); ok {
+			return value
+		}
+	}
+	return ""
+}
+
+// normalizeLevel maps the level names used by the common logging libraries
+// onto the names listed in logLevels
+func normalizeLevel(level string) string {
+	level = strings.ToLower(level)
+	switch level {
+	case "warning":
+		return "warn"
+	case "err":
+		return "error"
+	case "critical", "crit", "panic", "dpanic":
+		return "fatal"
+	}
+	return level
+}
+
+func newLineFilter(input ServiceLogs) (LineFilter, error) {
+	filter := LineFilter{Grep: input.Grep, Level: -1}
+
+	if input.Regex != "" {
+		regex, err := regexp.Compile(input.Regex)
+		if err != nil {
+			return filter, fmt.Errorf("invalid regex: %s", err.Error())
+		}
+		filter.Regex = regex
+	}
+
+	if input.Level != "" {
+		filter.Level = levelIndex(normalizeLevel(input.Level))
+		if filter.Level < 0 {
+			return filter, fmt.Errorf("unknown level %q (use %s)", input.Level, strings.Join(logLevels, ", "))
+		}
 	}
 
-	bytes, err := json.Marshal(string(out))
+	return filter, nil
+}
+
+// Match tells if the line contains the substring, matches the regex and is
+// at least as severe as the level of the filter. When filtering by level,
+// lines without a level are dropped.
+func (f LineFilter) Match(line LogLine) bool {
+	if f.Grep != "" && !strings.Contains(line.Message, f.Grep) {
+		return false
+	}
+	if f.Regex != nil && !f.Regex.MatchString(line.Message) {
+		return false
+	}
+	if f.Level >= 0 && levelIndex(line.Level) < f.Level {
+		return false
+	}
+	return true
+}
+
+func levelIndex(level string) int {
+	for i, name := range logLevels {
+		if name == level {
+			return i
+		}
+	}
+	return -1
+}
+
+// podNames returns the sorted names of the pods
+func podNames(pods []corev1.Pod) []string {
+	var names = []string{}
+	for _, pod := range pods {
+		names = append(names, pod.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func writeResult(w http.ResponseWriter, r *http.Request, result ServiceLogsResult) {
+	resultJSON, err := json.Marshal(result)
 	if err != nil {
-		log.Fatalf("[ERROR] Cannot convert logs to json format %s", err.Error())
+		httpError(w, r, http.StatusInternalServerError, "Cannot convert logs to json format %s", err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(resultJSON)
+}
+
+// httpError logs and answers the error, reporting and tracing the server
+// errors
+func httpError(w http.ResponseWriter, r *http.Request, status int, format string, v ...interface{}) {
+	message := fmt.Sprintf(format, v...)
+	logging.FromRequest(r).Errorf("%s", message)
+	if status >= http.StatusInternalServerError {
+		reporting.FromRequest(r).Reportf(format, v...)
+		tracing.FromRequest(r).Fail(fmt.Errorf(format, v...))
 	}
-	return fmt.Sprintf("{ \"logs\": %s}", string(bytes))
+	http.Error(w, message, status)
 }
 
 func validateInput(input string) error {
@@ -106,7 +593,47 @@ func validateInput(input string) error {
 	return nil
 }
 
-func validateData(input types.ServiceLogs) error {
-	// TODO: validation
+func validateData(input ServiceLogs) error {
+	if input.ServiceName == "" {
+		return fmt.Errorf("missing service name")
+	}
+
+	_, err := labels.Parse(input.LabelSelector)
+	if err != nil {
+		return fmt.Errorf("invalid label selector: %s", err.Error())
+	}
+
+	if input.SinceSeconds != nil && input.SinceTime != "" {
+		return fmt.Errorf("sinceSeconds and sinceTime cannot be used together")
+	}
+
+	if input.SinceTime != "" {
+		_, err = time.Parse(time.RFC3339, input.SinceTime)
+		if err != nil {
+			return fmt.Errorf("invalid sinceTime: %s", err.Error())
+		}
+	}
+
+	if input.SinceSeconds != nil && *input.SinceSeconds < 1 {
+		return fmt.Errorf("sinceSeconds must be positive")
+	}
+
+	if input.TailLines != nil && *input.TailLines < 0 {
+		return fmt.Errorf("tailLines must not be negative")
+	}
+
+	if input.LimitBytes != nil && *input.LimitBytes < 1 {
+		return fmt.Errorf("limitBytes must be positive")
+	}
+
+	if input.MaxDurationSeconds < 0 {
+		return fmt.Errorf("maxDurationSeconds must not be negative")
+	}
+
+	_, err = newLineFilter(input)
+	if err != nil {
+		return err
+	}
+
 	return nil
 }
@@ -0,0 +1,320 @@
+package function
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/automium/automium-gateway/pkg/apikey"
+	"github.com/automium/automium-gateway/pkg/logging"
+	"github.com/automium/automium-gateway/pkg/metrics"
+	"github.com/automium/automium-gateway/pkg/reporting"
+	"github.com/automium/automium-gateway/pkg/tracing"
+	types "github.com/automium/types/go/gateway"
+	v1beta1 "github.com/automium/types/go/v1beta1"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+const (
+	defaultMaxWatchDuration = 10 * time.Minute
+	formatSSE               = "sse"
+	formatNDJSON            = "ndjson"
+)
+
+var watchableResources = []string{"services", "nodes"}
+
+//TODO: move to the shared types lib
+type WatchServices struct {
+	Resources       []string
+	Namespace       string
+	LabelSelector   string
+	ResourceVersion string
+	Format          string
+	Kubeconfig      string
+}
+
+//TODO: move to the shared types lib
+type WatchEvent struct {
+	Type     watch.EventType `json:"type"`
+	Resource string          `json:"resource"`
+	Object   runtime.Object  `json:"object"`
+}
+
+func getAPISecret(secretName string) (secretBytes []byte, err error) {
+	root := "/var/openfaas/secrets/"
+
+	// read from the openfaas secrets folder
+	secretBytes, err = ioutil.ReadFile(root + secretName)
+	return secretBytes, err
+}
+
+// Handle a serverless request, streaming the Service and Node changes to the
+// caller until it disconnects or the maximum watch duration elapses
+func Handle(w http.ResponseWriter, r *http.Request) {
+	metrics.Instrument("watchservices", logging.Instrument("watchservices", reporting.Instrument("watchservices", tracing.Instrument("watchservices", handle))))(w, r)
+}
+
+func handle(w http.ResponseWriter, r *http.Request) {
+
+	recorder := metrics.FromRequest(r)
+	logger := logging.FromRequest(r).TrackPhase(recorder.CurrentPhase)
+	recorder.SetLogger(logger)
+	reporter := reporting.FromRequest(r)
+	reporter.Tag(logging.FieldRequestID, w.Header().Get(logging.RequestIDHeader))
+	requestTrace := tracing.FromRequest(r)
+	requestTrace.SetAttribute(logging.FieldRequestID, w.Header().Get(logging.RequestIDHeader))
+	requestTrace.SetAttribute(logging.FieldKeyID, apikey.ID(r.Header.Get("X-Api-Key")))
+	recorder.OnPhase(requestTrace.Phase)
+
+	phase := recorder.Phase(metrics.PhaseAuth)
+	err := validateInput(r.Header.Get("X-Api-Key"))
+	phase.Done(err)
+	if err != nil {
+		httpError(w, r, http.StatusUnauthorized, "Invalid input: %s", err.Error())
+		return
+	}
+
+	secretBytes, err := getAPISecret("KubeConfig")
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "Cannot read kubeconfig: %s", err.Error())
+		return
+	}
+
+	var kubeConfig types.KubernetesConfig
+	err = json.Unmarshal(secretBytes, &kubeConfig)
+
+	inputData := parseRequest(r)
+	inputData.Kubeconfig = kubeConfig.Kubeconfig
+
+	err = validateData(inputData)
+	if err != nil {
+		httpError(w, r, http.StatusBadRequest, "Invalid data: %s", err.Error())
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		httpError(w, r, http.StatusInternalServerError, "Streaming is not supported")
+		return
+	}
+
+	config, err := clientcmd.RESTConfigFromKubeConfig([]byte(inputData.Kubeconfig))
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "Cannot create configuration from provided kubeconfig: %s", err.Error())
+		return
+	}
+
+	client, err := createRESTClient(config)
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "Cannot prepare the client: %s", err.Error())
+		return
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+
+	events := make(chan WatchEvent)
+	closed := make(chan string)
+	for _, resource := range inputData.Resources {
+		phase = recorder.KubernetesPhase("WATCH", resource, "")
+		watcher, err := client.Get().Resource(resource).Namespace(inputData.Namespace).VersionedParams(&metav1.ListOptions{
+			Watch:           true,
+			LabelSelector:   inputData.LabelSelector,
+			ResourceVersion: inputData.ResourceVersion,
+		}, scheme.ParameterCodec).Watch()
+		phase.Done(err)
+		if err != nil {
+			httpError(w, r, http.StatusInternalServerError, "Cannot watch %s: %s", resource, err.Error())
+			return
+		}
+		defer watcher.Stop()
+
+		go forwardEvents(resource, watcher, events, closed, done)
+	}
+
+	if inputData.Format == formatSSE {
+		w.Header().Set("Content-Type", "text/event-stream")
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	timeout := time.NewTimer(maxWatchDuration())
+	defer timeout.Stop()
+
+	for {
+		select {
+		case event := <-events:
+			err = writeEvent(w, inputData.Format, event)
+			if err != nil {
+				logger.Errorf("Cannot write event: %s", err.Error())
+				return
+			}
+			flusher.Flush()
+		case resource := <-closed:
+			// The API server ends watches periodically: the caller resumes
+			// from the last resource version it received
+			logger.Infof("Watch on %s closed by the server", resource)
+			return
+		case <-timeout.C:
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func forwardEvents(resource string, watcher watch.Interface, events chan<- WatchEvent, closed chan<- string, done <-chan struct{}) {
+	for event := range watcher.ResultChan() {
+		select {
+		case events <- WatchEvent{Type: event.Type, Resource: resource, Object: event.Object}:
+		case <-done:
+			return
+		}
+	}
+
+	select {
+	case closed <- resource:
+	case <-done:
+	}
+}
+
+func writeEvent(w http.ResponseWriter, format string, event WatchEvent) error {
+	eventJSON, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	if format != formatSSE {
+		_, err = fmt.Fprintf(w, "%s\n", eventJSON)
+		return err
+	}
+
+	// The resource version is the SSE event id, so a reconnecting EventSource
+	// sends it back as Last-Event-ID and resumes from there
+	accessor, accessorErr := meta.Accessor(event.Object)
+	if accessorErr == nil && accessor.GetResourceVersion() != "" {
+		_, err = fmt.Fprintf(w, "id: %s\n", accessor.GetResourceVersion())
+		if err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, eventJSON)
+	return err
+}
+
+func parseRequest(r *http.Request) WatchServices {
+	query := r.URL.Query()
+
+	input := WatchServices{
+		Resources:       watchableResources,
+		Namespace:       query.Get("namespace"),
+		LabelSelector:   query.Get("labelSelector"),
+		ResourceVersion: query.Get("resourceVersion"),
+		Format:          query.Get("format"),
+	}
+
+	if resources := query.Get("resources"); resources != "" {
+		input.Resources = []string{}
+		for _, resource := range strings.Split(resources, ",") {
+			input.Resources = append(input.Resources, strings.TrimSpace(resource))
+		}
+	}
+
+	if input.ResourceVersion == "" {
+		input.ResourceVersion = r.Header.Get("Last-Event-ID")
+	}
+
+	if input.Format == "" {
+		input.Format = formatNDJSON
+		if strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+			input.Format = formatSSE
+		}
+	}
+
+	return input
+}
+
+func maxWatchDuration() time.Duration {
+	duration, err := time.ParseDuration(os.Getenv("max_watch_duration"))
+	if err != nil || duration <= 0 {
+		return defaultMaxWatchDuration
+	}
+	return duration
+}
+
+// httpError logs and answers the error, reporting and tracing the server
+// errors
+func httpError(w http.ResponseWriter, r *http.Request, status int, format string, v ...interface{}) {
+	message := fmt.Sprintf(format, v...)
+	logging.FromRequest(r).Errorf("%s", message)
+	if status >= http.StatusInternalServerError {
+		reporting.FromRequest(r).Reportf(format, v...)
+		tracing.FromRequest(r).Fail(fmt.Errorf(format, v...))
+	}
+	http.Error(w, message, status)
+}
+
+func createRESTClient(config *rest.Config) (*rest.RESTClient, error) {
+	v1beta1.AddToScheme(scheme.Scheme)
+
+	crdConfig := *config
+	crdConfig.ContentConfig.GroupVersion = &schema.GroupVersion{Group: v1beta1.GroupName, Version: v1beta1.GroupVersion}
+	crdConfig.APIPath = "/apis"
+	crdConfig.NegotiatedSerializer = serializer.DirectCodecFactory{CodecFactory: scheme.Codecs}
+	crdConfig.UserAgent = rest.DefaultKubernetesUserAgent()
+
+	rc, err := rest.UnversionedRESTClientFor(&crdConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	return rc, nil
+}
+
+func validateInput(input string) error {
+	//log.Printf("request with %s key", input)
+	// TODO: validation
+	return nil
+}
+
+func validateData(input WatchServices) error {
+	for _, resource := range input.Resources {
+		valid := false
+		for _, watchable := range watchableResources {
+			if resource == watchable {
+				valid = true
+			}
+		}
+		if !valid {
+			return fmt.Errorf("cannot watch %q (use %s)", resource, strings.Join(watchableResources, ", "))
+		}
+	}
+
+	if input.Format != formatSSE && input.Format != formatNDJSON {
+		return fmt.Errorf("unknown format %q (use %s or %s)", input.Format, formatSSE, formatNDJSON)
+	}
+
+	_, err := labels.Parse(input.LabelSelector)
+	if err != nil {
+		return fmt.Errorf("invalid label selector: %s", err.Error())
+	}
+
+	return nil
+}
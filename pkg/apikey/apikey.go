@@ -0,0 +1,20 @@
+// Package apikey identifies the API keys of the callers without exposing them.
+package apikey
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// idLength is the number of hex characters kept from the digest of the key
+const idLength = 12
+
+// ID returns a stable identifier of the key, safe to log and to report: the
+// key cannot be recovered from it. An empty key has an empty ID.
+func ID(key string) string {
+	if key == "" {
+		return ""
+	}
+	digest := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(digest[:])[:idLength]
+}
@@ -0,0 +1,219 @@
+// Package audit records who changed what through the mutating gateway
+// functions.
+//
+// Every call produces an Event, written to the sinks listed in the
+// audit_sinks environment variable (stdout by default):
+//
+//	stdout   JSON lines in the function logs
+//	file     JSON lines appended to audit_file
+//	webhook  JSON POSTed to audit_webhook_url
+//
+// Other sinks can be added with Register.
+package audit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/automium/automium-gateway/pkg/logging"
+)
+
+// Outcomes of a call
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+)
+
+const defaultSinks = "stdout"
+
+// Event of a mutating call
+type Event struct {
+	Time            time.Time `json:"time"`
+	Function        string    `json:"function"`
+	RequestID       string    `json:"requestId,omitempty"`
+	KeyID           string    `json:"keyId"`
+	SourceIP        string    `json:"sourceIp"`
+	Service         string    `json:"service,omitempty"`
+	Namespace       string    `json:"namespace,omitempty"`
+	PayloadSHA256   string    `json:"payloadSha256"`
+	Outcome         string    `json:"outcome"`
+	Error           string    `json:"error,omitempty"`
+	Commit          string    `json:"commit,omitempty"`
+	ResourceVersion string    `json:"resourceVersion,omitempty"`
+}
+
+// Sink stores the events
+type Sink interface {
+	Write(event Event) error
+}
+
+// Factory creates a sink
+type Factory func() (Sink, error)
+
+var (
+	factoriesMu sync.Mutex
+	factories   = map[string]Factory{
+		"stdout":  newStdoutSink,
+		"file":    newFileSinkFromEnv,
+		"webhook": newWebhookSinkFromEnv,
+	}
+)
+
+// Register makes a sink available by name
+func Register(name string, factory Factory) {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+	factories[name] = factory
+}
+
+// Sinks returns the sinks configured in the environment. The sinks that
+// cannot be created are reported in the error and skipped, and when none can
+// be created the events go to stdout: a wrong entry must not stop the
+// auditing.
+func Sinks() ([]Sink, error) {
+	names := os.Getenv("audit_sinks")
+	if names == "" {
+		names = defaultSinks
+	}
+
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+
+	var sinks []Sink
+	var errs []string
+	for _, name := range strings.Split(names, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		factory, ok := factories[name]
+		if !ok {
+			errs = append(errs, fmt.Sprintf("unknown audit sink %s", name))
+			continue
+		}
+		sink, err := factory()
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("cannot create audit sink %s: %s", name, err.Error()))
+			continue
+		}
+		sinks = append(sinks, sink)
+	}
+
+	if len(errs) == 0 {
+		return sinks, nil
+	}
+	if len(sinks) == 0 {
+		sink, _ := newStdoutSink()
+		sinks = append(sinks, sink)
+	}
+	return sinks, fmt.Errorf("%s", strings.Join(errs, "; "))
+}
+
+// Auditor builds and records the event of a call
+type Auditor struct {
+	mu     sync.Mutex
+	event  Event
+	sinks  []Sink
+	logger *logging.Logger
+	once   sync.Once
+}
+
+// New starts auditing a call to the function, writing to the configured
+// sinks
+func New(function string) *Auditor {
+	auditor := &Auditor{event: Event{Function: function}, logger: logging.New(function)}
+	sinks, err := Sinks()
+	if err != nil {
+		auditor.logger.Errorf("%s", err.Error())
+	}
+	auditor.sinks = sinks
+	return auditor
+}
+
+// WithSinks replaces the sinks of the auditor, e.g. with a WriterSink in
+// tests
+func (a *Auditor) WithSinks(sinks ...Sink) *Auditor {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.sinks = sinks
+	return a
+}
+
+// Request sets the ID of the request and the hash of its body: the body
+// itself may carry secrets, so it is never recorded
+func (a *Auditor) Request(requestID string, payload []byte) {
+	digest := sha256.Sum256(payload)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.event.RequestID = requestID
+	a.event.PayloadSHA256 = hex.EncodeToString(digest[:])
+}
+
+// Caller sets who made the call: the ID of the API key and the source IP
+func (a *Auditor) Caller(keyID string, sourceIP string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.event.KeyID = keyID
+	a.event.SourceIP = sourceIP
+}
+
+// Target sets the service changed by the call
+func (a *Auditor) Target(service string, namespace string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.event.Service = service
+	a.event.Namespace = namespace
+}
+
+// Commit sets the SHA of the commit made by the call
+func (a *Auditor) Commit(sha string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.event.Commit = sha
+}
+
+// ResourceVersion sets the version of the resource changed by the call
+func (a *Auditor) ResourceVersion(resourceVersion string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.event.ResourceVersion = resourceVersion
+}
+
+// Record writes the event, failed when err is not nil. Only the first call
+// is recorded.
+func (a *Auditor) Record(err error) {
+	a.once.Do(func() {
+		a.mu.Lock()
+		event := a.event
+		sinks := a.sinks
+		a.mu.Unlock()
+
+		event.Time = time.Now().UTC()
+		event.Outcome = OutcomeSuccess
+		if err != nil {
+			event.Outcome = OutcomeFailure
+			event.Error = err.Error()
+		}
+
+		for _, sink := range sinks {
+			writeErr := sink.Write(event)
+			if writeErr != nil {
+				a.logger.Errorf("Cannot write audit event: %s", writeErr.Error())
+			}
+		}
+	})
+}
+
+// SourceIP returns the IP of the caller from the headers set by the OpenFaaS
+// gateway: the first address of X-Forwarded-For, or X-Real-Ip
+func SourceIP(forwardedFor string, realIP string) string {
+	if forwardedFor != "" {
+		return strings.TrimSpace(strings.Split(forwardedFor, ",")[0])
+	}
+	return strings.TrimSpace(realIP)
+}
@@ -0,0 +1,102 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestSinks(t *testing.T) {
+	tests := []struct {
+		name      string
+		env       map[string]string
+		sinks     []string
+		shouldErr bool
+	}{
+		{"default", map[string]string{}, []string{"*audit.WriterSink"}, false},
+		{"list", map[string]string{"audit_sinks": " STDOUT, file,,webhook ", "audit_file": "/tmp/audit.log", "audit_webhook_url": "http://audit"}, []string{"*audit.WriterSink", "*audit.FileSink", "*audit.WebhookSink"}, false},
+		{"unknown sink", map[string]string{"audit_sinks": "file,syslog", "audit_file": "/tmp/audit.log"}, []string{"*audit.FileSink"}, true},
+		{"sink without configuration", map[string]string{"audit_sinks": "file,webhook", "audit_webhook_url": "http://audit"}, []string{"*audit.WebhookSink"}, true},
+		{"no valid sink", map[string]string{"audit_sinks": "syslog,file"}, []string{"*audit.WriterSink"}, true},
+	}
+
+	for _, test := range tests {
+		restore := setenv(test.env, "audit_sinks", "audit_file", "audit_webhook_url")
+		sinks, err := Sinks()
+		restore()
+
+		if (err != nil) != test.shouldErr {
+			t.Errorf("%s: expected error %t, got %v", test.name, test.shouldErr, err)
+		}
+		var actual []string
+		for _, sink := range sinks {
+			actual = append(actual, reflect.TypeOf(sink).String())
+		}
+		if !reflect.DeepEqual(actual, test.sinks) {
+			t.Errorf("%s: expected sinks %v, got %v", test.name, test.sinks, actual)
+		}
+	}
+}
+
+func TestRecord(t *testing.T) {
+	tests := []struct {
+		name    string
+		err     error
+		outcome string
+	}{
+		{"success", nil, OutcomeSuccess},
+		{"failure", errors.New("push rejected"), OutcomeFailure},
+	}
+
+	for _, test := range tests {
+		var output bytes.Buffer
+		auditor := New("savespec").WithSinks(NewWriterSink(&output))
+		auditor.Request("42", []byte(`{"key":"secret"}`))
+		auditor.Caller("3f2a9c1b7d4e", SourceIP("10.0.0.12, 10.0.0.1", ""))
+		auditor.Target("web", "default")
+		auditor.Record(test.err)
+		auditor.Record(nil)
+
+		var event Event
+		err := json.Unmarshal(output.Bytes(), &event)
+		if err != nil {
+			t.Fatalf("%s: expected a single event, got %q", test.name, output.String())
+		}
+		if event.Outcome != test.outcome || event.Function != "savespec" || event.Service != "web" || event.SourceIP != "10.0.0.12" {
+			t.Errorf("%s: unexpected event %+v", test.name, event)
+		}
+		if bytes.Contains(output.Bytes(), []byte("secret")) {
+			t.Errorf("%s: the event carries the payload: %s", test.name, output.String())
+		}
+		if test.err != nil && event.Error != test.err.Error() {
+			t.Errorf("%s: expected error %s, got %s", test.name, test.err.Error(), event.Error)
+		}
+	}
+}
+
+// setenv sets the variables of env, clearing the other names, and returns
+// the function restoring them
+func setenv(env map[string]string, names ...string) func() {
+	previous := map[string]string{}
+	for _, name := range names {
+		if value, ok := os.LookupEnv(name); ok {
+			previous[name] = value
+		}
+		os.Unsetenv(name)
+	}
+	for name, value := range env {
+		os.Setenv(name, value)
+	}
+
+	return func() {
+		for _, name := range names {
+			os.Unsetenv(name)
+			if value, ok := previous[name]; ok {
+				os.Setenv(name, value)
+			}
+		}
+	}
+}
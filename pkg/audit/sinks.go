@@ -0,0 +1,113 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const webhookTimeout = 5 * time.Second
+
+// WriterSink writes the events as JSON lines
+type WriterSink struct {
+	mu  sync.Mutex
+	out io.Writer
+}
+
+// NewWriterSink returns a sink writing to out
+func NewWriterSink(out io.Writer) *WriterSink {
+	return &WriterSink{out: out}
+}
+
+// newStdoutSink writes to the function logs: stdout carries the response of
+// the classic watchdog, so the events go to stderr
+func newStdoutSink() (Sink, error) {
+	return NewWriterSink(os.Stderr), nil
+}
+
+// Write writes the event
+func (s *WriterSink) Write(event Event) error {
+	eventJSON, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.out.Write(append(eventJSON, '\n'))
+	return err
+}
+
+// FileSink appends the events as JSON lines to a file
+type FileSink struct {
+	Path string
+}
+
+// NewFileSink returns a sink appending to the file at path
+func NewFileSink(path string) *FileSink {
+	return &FileSink{Path: path}
+}
+
+func newFileSinkFromEnv() (Sink, error) {
+	path := os.Getenv("audit_file")
+	if path == "" {
+		return nil, fmt.Errorf("audit_file is not set")
+	}
+	return NewFileSink(path), nil
+}
+
+// Write appends the event
+func (s *FileSink) Write(event Event) error {
+	file, err := os.OpenFile(s.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	err = NewWriterSink(file).Write(event)
+	closeErr := file.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// WebhookSink POSTs the events as JSON to a URL
+type WebhookSink struct {
+	URL    string
+	Client *http.Client
+}
+
+// NewWebhookSink returns a sink posting to url
+func NewWebhookSink(url string) *WebhookSink {
+	return &WebhookSink{URL: url, Client: &http.Client{Timeout: webhookTimeout}}
+}
+
+func newWebhookSinkFromEnv() (Sink, error) {
+	url := os.Getenv("audit_webhook_url")
+	if url == "" {
+		return nil, fmt.Errorf("audit_webhook_url is not set")
+	}
+	return NewWebhookSink(url), nil
+}
+
+// Write posts the event
+func (s *WebhookSink) Write(event Event) error {
+	eventJSON, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	response, err := s.Client.Post(s.URL, "application/json", bytes.NewReader(eventJSON))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s from %s", response.Status, s.URL)
+	}
+	return nil
+}
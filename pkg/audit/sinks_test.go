@@ -0,0 +1,84 @@
+package audit
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFileSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sink := NewFileSink(filepath.Join(dir, "audit.log"))
+	for _, service := range []string{"web", "db"} {
+		err = sink.Write(Event{Function: "savespec", Service: service, Outcome: OutcomeSuccess})
+		if err != nil {
+			t.Fatalf("Write returned %s", err.Error())
+		}
+	}
+
+	content, err := ioutil.ReadFile(sink.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines, got %q", content)
+	}
+	var event Event
+	err = json.Unmarshal([]byte(lines[1]), &event)
+	if err != nil || event.Service != "db" {
+		t.Errorf("unexpected last line %s", lines[1])
+	}
+
+	err = NewFileSink(filepath.Join(dir, "missing", "audit.log")).Write(Event{})
+	if err == nil {
+		t.Errorf("expected an error writing to a missing directory")
+	}
+}
+
+func TestWebhookSink(t *testing.T) {
+	tests := []struct {
+		name      string
+		status    int
+		shouldErr bool
+	}{
+		{"accepted", http.StatusAccepted, false},
+		{"rejected", http.StatusBadRequest, true},
+		{"failing", http.StatusInternalServerError, true},
+	}
+
+	for _, test := range tests {
+		var received Event
+		var contentType string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			contentType = r.Header.Get("Content-Type")
+			json.NewDecoder(r.Body).Decode(&received)
+			w.WriteHeader(test.status)
+		}))
+
+		err := NewWebhookSink(server.URL).Write(Event{Function: "applyservice", Service: "web"})
+		server.Close()
+
+		if (err != nil) != test.shouldErr {
+			t.Errorf("%s: expected error %t, got %v", test.name, test.shouldErr, err)
+		}
+		if received.Service != "web" || contentType != "application/json" {
+			t.Errorf("%s: unexpected request %s %+v", test.name, contentType, received)
+		}
+	}
+
+	err := NewWebhookSink("http://127.0.0.1:1").Write(Event{})
+	if err == nil {
+		t.Errorf("expected an error posting to a closed port")
+	}
+}
@@ -0,0 +1,35 @@
+package logging
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/automium/automium-gateway/pkg/apikey"
+)
+
+type contextKey struct{}
+
+// Instrument wraps the handler of a function built on the HTTP watchdog: it
+// returns the request ID in the X-Request-Id header and makes a Logger
+// stamped with it and the API key ID available through FromRequest
+func Instrument(function string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// The OpenFaaS gateway sets X-Call-Id on every call
+		requestID := RequestID(r.Header.Get(RequestIDHeader), r.Header.Get("X-Call-Id"))
+		w.Header().Set(RequestIDHeader, requestID)
+
+		logger := New(function)
+		logger.Set(FieldRequestID, requestID)
+		logger.Set(FieldKeyID, apikey.ID(r.Header.Get("X-Api-Key")))
+		next(w, r.WithContext(context.WithValue(r.Context(), contextKey{}, logger)))
+	}
+}
+
+// FromRequest returns the Logger of a request served through Instrument
+func FromRequest(r *http.Request) *Logger {
+	logger, ok := r.Context().Value(contextKey{}).(*Logger)
+	if !ok {
+		return New("unknown")
+	}
+	return logger
+}
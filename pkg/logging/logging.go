@@ -0,0 +1,188 @@
+// Package logging writes the logs of the gateway functions as JSON lines,
+// stamped with the function and the context of the request: request ID,
+// API key ID, service and phase.
+//
+// The lowest level logged is set with the log_level environment variable
+// (debug, info, warn or error; info by default).
+package logging
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Levels of the log lines
+const (
+	LevelDebug = "debug"
+	LevelInfo  = "info"
+	LevelWarn  = "warn"
+	LevelError = "error"
+	LevelFatal = "fatal"
+)
+
+// levels are sorted by severity
+var levels = []string{LevelDebug, LevelInfo, LevelWarn, LevelError, LevelFatal}
+
+// Names of the context fields
+const (
+	FieldFunction  = "function"
+	FieldRequestID = "requestId"
+	FieldKeyID     = "keyId"
+	FieldService   = "service"
+	FieldPhase     = "phase"
+)
+
+// RequestIDHeader carries the ID of a request
+const RequestIDHeader = "X-Request-Id"
+
+// Logger writes the log lines of a request
+type Logger struct {
+	mu     sync.Mutex
+	out    io.Writer
+	level  int
+	fields map[string]string
+	phase  func() string
+}
+
+// New returns a logger for a request to the function, writing to stderr
+func New(function string) *Logger {
+	level := levelIndex(os.Getenv("log_level"))
+	if level < 0 {
+		level = levelIndex(LevelInfo)
+	}
+	return &Logger{
+		out:    os.Stderr,
+		level:  level,
+		fields: map[string]string{FieldFunction: function},
+	}
+}
+
+// Set adds a field to the context of the following lines. Fields must never
+// carry secrets: identify the API key with apikey.ID.
+func (l *Logger) Set(name string, value string) {
+	if value == "" {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.fields[name] = value
+}
+
+// TrackPhase stamps the lines with the phase returned by current, e.g. the
+// CurrentPhase of the metrics recorder of the request
+func (l *Logger) TrackPhase(current func() string) *Logger {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.phase = current
+	return l
+}
+
+// Debugf logs at debug level
+func (l *Logger) Debugf(format string, v ...interface{}) {
+	l.log(LevelDebug, format, v...)
+}
+
+// Infof logs at info level
+func (l *Logger) Infof(format string, v ...interface{}) {
+	l.log(LevelInfo, format, v...)
+}
+
+// Warnf logs at warn level
+func (l *Logger) Warnf(format string, v ...interface{}) {
+	l.log(LevelWarn, format, v...)
+}
+
+// Errorf logs at error level
+func (l *Logger) Errorf(format string, v ...interface{}) {
+	l.log(LevelError, format, v...)
+}
+
+// Fatalf logs at fatal level and exits
+func (l *Logger) Fatalf(format string, v ...interface{}) {
+	l.log(LevelFatal, format, v...)
+	os.Exit(1)
+}
+
+func (l *Logger) log(level string, format string, v ...interface{}) {
+	if levelIndex(level) < l.level {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	line := make(map[string]string, len(l.fields)+4)
+	for name, value := range l.fields {
+		line[name] = value
+	}
+	if l.phase != nil {
+		if phase := l.phase(); phase != "" {
+			line[FieldPhase] = phase
+		}
+	}
+	line["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	line["level"] = level
+	line["msg"] = fmt.Sprintf(format, v...)
+
+	lineJSON, err := json.Marshal(line)
+	if err != nil {
+		return
+	}
+	l.out.Write(append(lineJSON, '\n'))
+}
+
+func levelIndex(level string) int {
+	level = strings.ToLower(strings.TrimSpace(level))
+	for i, name := range levels {
+		if name == level {
+			return i
+		}
+	}
+	return -1
+}
+
+// RequestID returns the first ID set among the candidates, usually the
+// request headers, or a new random one
+func RequestID(candidates ...string) string {
+	for _, candidate := range candidates {
+		if candidate = strings.TrimSpace(candidate); candidate != "" {
+			return candidate
+		}
+	}
+
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	if err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(id)
+}
+
+// WithRequestID adds the requestId field to a JSON object response. The
+// functions built on the classic watchdog cannot set response headers, so
+// this is how they return the request ID. Other responses are left as they
+// are.
+func WithRequestID(response string, requestID string) string {
+	trimmed := strings.TrimSpace(response)
+	if !strings.HasPrefix(trimmed, "{") || !json.Valid([]byte(trimmed)) {
+		return response
+	}
+
+	idJSON, err := json.Marshal(requestID)
+	if err != nil {
+		return response
+	}
+
+	rest := strings.TrimSpace(trimmed[1:])
+	if rest != "}" {
+		rest = ", " + rest
+	}
+	return fmt.Sprintf("{\"%s\": %s%s", FieldRequestID, idJSON, rest)
+}
@@ -0,0 +1,77 @@
+package metrics
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/automium/automium-gateway/pkg/logging"
+)
+
+// ContentType of the Prometheus text format
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+type contextKey struct{}
+
+// Instrument wraps the handler of a function built on the HTTP watchdog: it
+// records every request, makes its Recorder available through FromRequest
+// and serves the metrics of the process on /metrics.
+func Instrument(function string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/metrics" {
+			w.Header().Set("Content-Type", ContentType)
+			err := Default.Write(w)
+			if err != nil {
+				logger := logging.New(function)
+				logger.Set(logging.FieldRequestID, logging.RequestID(r.Header.Get(logging.RequestIDHeader), r.Header.Get("X-Call-Id")))
+				logger.Errorf("Cannot write metrics: %s", err.Error())
+			}
+			return
+		}
+
+		recorder := New(function)
+		writer := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		next(writer, r.WithContext(context.WithValue(r.Context(), contextKey{}, recorder)))
+		recorder.Finish(outcomeOf(writer.status))
+	}
+}
+
+// FromRequest returns the Recorder of a request served through Instrument
+func FromRequest(r *http.Request) *Recorder {
+	recorder, ok := r.Context().Value(contextKey{}).(*Recorder)
+	if !ok {
+		return New("unknown")
+	}
+	return recorder
+}
+
+func outcomeOf(status int) string {
+	switch {
+	case status >= 500:
+		return OutcomeError
+	case status >= 400:
+		return OutcomeClientError
+	}
+	return OutcomeSuccess
+}
+
+// statusWriter keeps track of the status of the response, and still lets
+// the handlers stream it
+type statusWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.status = status
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
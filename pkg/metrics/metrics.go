@@ -0,0 +1,195 @@
+// Package metrics records the requests served by the gateway functions and
+// the time spent in each phase, and exposes them in the Prometheus text format.
+//
+// Functions built on the classic watchdog run a process per request, so their
+// metrics are pushed to a Pushgateway compatible endpoint at the end of the
+// request; functions built on the HTTP watchdog also serve them on /metrics.
+package metrics
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	"github.com/automium/automium-gateway/pkg/logging"
+)
+
+// Outcomes of a request
+const (
+	OutcomeSuccess     = "success"
+	OutcomeClientError = "client_error"
+	OutcomeError       = "error"
+)
+
+// Phases of a request
+const (
+	PhaseAuth       = "auth"
+	PhaseGitClone   = "git_clone"
+	PhaseGitCommit  = "git_commit"
+	PhaseGitPush    = "git_push"
+	PhaseKubernetes = "k8s"
+)
+
+// Attributes describing a phase to the hooks. They are not recorded in the
+// metrics, to keep their cardinality low.
+const (
+	// AttributeOperation tells what the phase does, e.g. "POST services"
+	AttributeOperation = "operation"
+	AttributeVerb      = "k8s.verb"
+	AttributeResource  = "k8s.resource"
+	AttributeService   = "service"
+)
+
+// Names of the metrics
+const (
+	RequestsTotal          = "automium_gateway_requests_total"
+	RequestDurationSeconds = "automium_gateway_request_duration_seconds"
+	PhasesTotal            = "automium_gateway_phases_total"
+	PhaseDurationSeconds   = "automium_gateway_phase_duration_seconds"
+)
+
+// Default is the registry of the process, where every recorder reports
+var Default = NewRegistry()
+
+func init() {
+	Default.Describe(RequestsTotal, "Requests served by the gateway functions.")
+	Default.Describe(RequestDurationSeconds, "Time spent serving the requests.")
+	Default.Describe(PhasesTotal, "Phases run while serving the requests.")
+	Default.Describe(PhaseDurationSeconds, "Time spent in each phase of the requests.")
+}
+
+// Recorder records the metrics of a single request
+type Recorder struct {
+	function string
+	start    time.Time
+	once     sync.Once
+
+	mu     sync.Mutex
+	phase  string
+	hooks  []PhaseHook
+	logger *logging.Logger
+}
+
+// PhaseHook is notified when a phase starts, with the attributes describing
+// it, e.g. to trace it, and returns the function notified when the phase is
+// done
+type PhaseHook func(name string, attributes map[string]string) func(err error)
+
+// Phase times a phase of a request
+type Phase struct {
+	recorder *Recorder
+	name     string
+	start    time.Time
+	done     []func(err error)
+}
+
+// New starts recording a request to the function
+func New(function string) *Recorder {
+	return &Recorder{function: function, start: time.Now(), logger: logging.New(function)}
+}
+
+// SetLogger makes the recorder log its own errors, e.g. a failed push, with
+// the context of the request
+func (r *Recorder) SetLogger(logger *logging.Logger) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.logger = logger
+}
+
+// Phase starts timing a phase of the request
+func (r *Recorder) Phase(name string) *Phase {
+	return r.PhaseWith(name, nil)
+}
+
+// KubernetesPhase starts timing a call to the Kubernetes API, described by
+// its verb, its resource and the service it is about, if any
+func (r *Recorder) KubernetesPhase(verb string, resource string, service string) *Phase {
+	attributes := map[string]string{
+		AttributeOperation: verb + " " + resource,
+		AttributeVerb:      verb,
+		AttributeResource:  resource,
+	}
+	if service != "" {
+		attributes[AttributeService] = service
+	}
+	return r.PhaseWith(PhaseKubernetes, attributes)
+}
+
+// PhaseWith starts timing a phase of the request, described to the hooks by
+// the attributes
+func (r *Recorder) PhaseWith(name string, attributes map[string]string) *Phase {
+	r.setPhase(name)
+
+	r.mu.Lock()
+	hooks := r.hooks
+	r.mu.Unlock()
+
+	phase := &Phase{recorder: r, name: name, start: time.Now()}
+	for _, hook := range hooks {
+		phase.done = append(phase.done, hook(name, attributes))
+	}
+	return phase
+}
+
+// OnPhase registers a hook notified of every phase of the request
+func (r *Recorder) OnPhase(hook PhaseHook) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.hooks = append(r.hooks, hook)
+}
+
+// CurrentPhase returns the phase running, or the last one if it failed, so
+// the errors of a request can be attributed to it
+func (r *Recorder) CurrentPhase() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.phase
+}
+
+func (r *Recorder) setPhase(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.phase = name
+}
+
+// Done records the phase, failed when err is not nil
+func (p *Phase) Done(err error) {
+	outcome := OutcomeSuccess
+	if err != nil {
+		outcome = OutcomeError
+	} else {
+		p.recorder.setPhase("")
+	}
+
+	for _, done := range p.done {
+		done(err)
+	}
+
+	labels := Labels{"function": p.recorder.function, "phase": p.name, "outcome": outcome}
+	Default.Add(PhasesTotal, labels, 1)
+	Default.Observe(PhaseDurationSeconds, Labels{"function": p.recorder.function, "phase": p.name}, time.Since(p.start).Seconds())
+}
+
+// Finish records the request with its outcome and pushes the metrics when a
+// Pushgateway is configured. Only the first call is recorded, so a deferred
+// Finish does not count again a request already finished with an error.
+func (r *Recorder) Finish(outcome string) {
+	r.once.Do(func() {
+		labels := Labels{"function": r.function, "outcome": outcome}
+		Default.Add(RequestsTotal, labels, 1)
+		Default.Observe(RequestDurationSeconds, labels, time.Since(r.start).Seconds())
+
+		url := os.Getenv("metrics_pushgateway_url")
+		if url == "" {
+			return
+		}
+		err := Push(url, r.function, Default)
+		if err != nil {
+			r.mu.Lock()
+			logger := r.logger
+			r.mu.Unlock()
+			// metrics must never fail a request
+			logger.Errorf("Cannot push metrics: %s", err.Error())
+		}
+	})
+}
@@ -0,0 +1,47 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const pushTimeout = 5 * time.Second
+
+// Push sends the metrics of the registry to a Pushgateway compatible
+// endpoint, grouped by function and instance.
+//
+// Processes of the classic watchdog serve a single request: push them to an
+// aggregating gateway, which sums the counters and histograms of every push,
+// rather than to a plain Pushgateway that keeps only the last one.
+func Push(gatewayURL string, function string, registry *Registry) error {
+	instance, err := os.Hostname()
+	if err != nil {
+		instance = "unknown"
+	}
+
+	var body bytes.Buffer
+	err = registry.Write(&body)
+	if err != nil {
+		return err
+	}
+
+	endpoint := fmt.Sprintf("%s/metrics/job/automium_gateway/function/%s/instance/%s",
+		strings.TrimSuffix(gatewayURL, "/"), url.PathEscape(function), url.PathEscape(instance))
+
+	client := &http.Client{Timeout: pushTimeout}
+	response, err := client.Post(endpoint, ContentType, &body)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s from %s", response.Status, endpoint)
+	}
+	return nil
+}
@@ -0,0 +1,216 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Buckets of the duration histograms, in seconds
+var Buckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// Labels of a series
+type Labels map[string]string
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Registry holds counters, gauges and histograms and renders them in the
+// Prometheus text format
+type Registry struct {
+	mu         sync.Mutex
+	help       map[string]string
+	counters   map[string]map[string]*sample
+	gauges     map[string]map[string]*sample
+	histograms map[string]map[string]*histogram
+}
+
+type sample struct {
+	labels Labels
+	value  float64
+}
+
+type histogram struct {
+	labels Labels
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// NewRegistry returns an empty registry
+func NewRegistry() *Registry {
+	return &Registry{
+		help:       map[string]string{},
+		counters:   map[string]map[string]*sample{},
+		gauges:     map[string]map[string]*sample{},
+		histograms: map[string]map[string]*histogram{},
+	}
+}
+
+// Describe sets the help text of a metric
+func (r *Registry) Describe(name string, help string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.help[name] = help
+}
+
+// Add increments a counter
+func (r *Registry) Add(name string, labels Labels, value float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.sample(r.counters, name, labels).value += value
+}
+
+// Set sets the value of a gauge
+func (r *Registry) Set(name string, labels Labels, value float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.sample(r.gauges, name, labels).value = value
+}
+
+func (r *Registry) sample(metrics map[string]map[string]*sample, name string, labels Labels) *sample {
+	series, ok := metrics[name]
+	if !ok {
+		series = map[string]*sample{}
+		metrics[name] = series
+	}
+
+	key := labels.String()
+	s, ok := series[key]
+	if !ok {
+		s = &sample{labels: labels}
+		series[key] = s
+	}
+	return s
+}
+
+// Observe records a value in a histogram
+func (r *Registry) Observe(name string, labels Labels, value float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	series, ok := r.histograms[name]
+	if !ok {
+		series = map[string]*histogram{}
+		r.histograms[name] = series
+	}
+
+	key := labels.String()
+	h, ok := series[key]
+	if !ok {
+		h = &histogram{labels: labels, counts: make([]uint64, len(Buckets))}
+		series[key] = h
+	}
+	for i, bound := range Buckets {
+		if value <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += value
+}
+
+// Write renders the metrics in the Prometheus text format
+func (r *Registry) Write(w io.Writer) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var output bytes.Buffer
+
+	r.writeSamples(&output, r.counters, "counter")
+	r.writeSamples(&output, r.gauges, "gauge")
+
+	var names []string
+	for name := range r.histograms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		r.writeHeader(&output, name, "histogram")
+		var keys []string
+		for key := range r.histograms[name] {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			h := r.histograms[name][key]
+			for i, bound := range Buckets {
+				fmt.Fprintf(&output, "%s_bucket%s %d\n", name, h.labels.with("le", formatValue(bound)), h.counts[i])
+			}
+			fmt.Fprintf(&output, "%s_bucket%s %d\n", name, h.labels.with("le", "+Inf"), h.count)
+			fmt.Fprintf(&output, "%s_sum%s %s\n", name, key, formatValue(h.sum))
+			fmt.Fprintf(&output, "%s_count%s %d\n", name, key, h.count)
+		}
+	}
+
+	_, err := output.WriteTo(w)
+	return err
+}
+
+func (r *Registry) writeSamples(w io.Writer, metrics map[string]map[string]*sample, kind string) {
+	var names []string
+	for name := range metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		r.writeHeader(w, name, kind)
+		var keys []string
+		for key := range metrics[name] {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fmt.Fprintf(w, "%s%s %s\n", name, key, formatValue(metrics[name][key].value))
+		}
+	}
+}
+
+func (r *Registry) writeHeader(w io.Writer, name string, kind string) {
+	if help, ok := r.help[name]; ok {
+		fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	}
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+}
+
+// String renders the labels as they appear in the text format, sorted by name
+func (l Labels) String() string {
+	if len(l) == 0 {
+		return ""
+	}
+
+	names := make([]string, 0, len(l))
+	for name := range l {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pairs := make([]string, 0, len(l))
+	for _, name := range names {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", name, labelEscaper.Replace(l[name])))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func (l Labels) with(name string, value string) string {
+	labels := Labels{name: value}
+	for k, v := range l {
+		labels[k] = v
+	}
+	return labels.String()
+}
+
+func formatValue(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
@@ -0,0 +1,73 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRegistryWrite(t *testing.T) {
+	registry := NewRegistry()
+	registry.Describe("requests_total", "Requests served.")
+	registry.Add("requests_total", Labels{"outcome": "success", "function": "savespec"}, 1)
+	registry.Add("requests_total", Labels{"function": "savespec", "outcome": "success"}, 2)
+	registry.Add("requests_total", Labels{"function": "deletespec", "outcome": "error"}, 1)
+	registry.Set("replicas", Labels{"service": "web"}, 3)
+	registry.Set("replicas", Labels{"service": "web"}, 2)
+	registry.Observe("duration_seconds", nil, 0.3)
+	registry.Observe("duration_seconds", nil, 120)
+
+	var output bytes.Buffer
+	err := registry.Write(&output)
+	if err != nil {
+		t.Fatalf("Write returned %s", err.Error())
+	}
+
+	expected := []string{
+		"# HELP requests_total Requests served.",
+		"# TYPE requests_total counter",
+		`requests_total{function="deletespec",outcome="error"} 1`,
+		`requests_total{function="savespec",outcome="success"} 3`,
+		"# TYPE replicas gauge",
+		`replicas{service="web"} 2`,
+		"# TYPE duration_seconds histogram",
+		`duration_seconds_bucket{le="0.25"} 0`,
+		`duration_seconds_bucket{le="0.5"} 1`,
+		`duration_seconds_bucket{le="60"} 1`,
+		`duration_seconds_bucket{le="+Inf"} 2`,
+		"duration_seconds_sum 120.3",
+		"duration_seconds_count 2",
+	}
+	lines := strings.Split(output.String(), "\n")
+	for _, line := range expected {
+		if !contains(lines, line) {
+			t.Errorf("missing %q in:\n%s", line, output.String())
+		}
+	}
+}
+
+func TestLabelsString(t *testing.T) {
+	tests := []struct {
+		labels   Labels
+		expected string
+	}{
+		{nil, ""},
+		{Labels{"b": "2", "a": "1"}, `{a="1",b="2"}`},
+		{Labels{"message": "say \"hi\"\nback\\slash"}, `{message="say \"hi\"\nback\\slash"}`},
+	}
+
+	for _, test := range tests {
+		if actual := test.labels.String(); actual != test.expected {
+			t.Errorf("%v: expected %s, got %s", test.labels, test.expected, actual)
+		}
+	}
+}
+
+func contains(lines []string, line string) bool {
+	for _, l := range lines {
+		if l == line {
+			return true
+		}
+	}
+	return false
+}
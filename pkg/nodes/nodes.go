@@ -0,0 +1,123 @@
+// Package nodes relates the Automium Nodes to their Services and tells their
+// state, so every function reports the infrastructure with the same rules.
+//
+// The state of a node is read from the node_state_field path of the node
+// (default status.phase), and the node is ready when the state is one of the
+// comma separated node_ready_states (default ready,running,passing).
+package nodes
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+
+	v1beta1 "github.com/automium/types/go/v1beta1"
+)
+
+// ServiceLabel is the label applyservice sets on the services, and the
+// operator on their nodes
+const ServiceLabel = "app"
+
+// Defaults of the rules
+const (
+	DefaultStateField  = "status.phase"
+	DefaultReadyStates = "ready,running,passing"
+)
+
+// Rules tell the state of the nodes
+type Rules struct {
+	// StateField is the dotted path of the state in the node
+	StateField string
+	// ReadyStates are the comma separated states of a ready node
+	ReadyStates string
+}
+
+// RulesFromEnv returns the rules of the function environment
+func RulesFromEnv() Rules {
+	rules := Rules{
+		StateField:  os.Getenv("node_state_field"),
+		ReadyStates: os.Getenv("node_ready_states"),
+	}
+	if rules.StateField == "" {
+		rules.StateField = DefaultStateField
+	}
+	if rules.ReadyStates == "" {
+		rules.ReadyStates = DefaultReadyStates
+	}
+	return rules
+}
+
+// State reads the lowercase state of the node from the dotted path of its
+// JSON representation: the status is owned by the Automium operator, so the
+// functions do not depend on its Go types. A node not reporting a state has
+// an empty one.
+func (r Rules) State(node v1beta1.Node) string {
+	nodeJSON, err := json.Marshal(node)
+	if err != nil {
+		return ""
+	}
+
+	var value interface{}
+	err = json.Unmarshal(nodeJSON, &value)
+	if err != nil {
+		return ""
+	}
+
+	for _, field := range strings.Split(r.StateField, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return ""
+		}
+		value = object[field]
+	}
+
+	state, ok := value.(string)
+	if !ok {
+		return ""
+	}
+	return strings.ToLower(state)
+}
+
+// IsReady tells if the state is a ready one
+func (r Rules) IsReady(state string) bool {
+	for _, readyState := range strings.Split(r.ReadyStates, ",") {
+		if strings.ToLower(strings.TrimSpace(readyState)) == state {
+			return true
+		}
+	}
+	return false
+}
+
+// Service returns the service owning the node, or carrying the same app
+// label that applyservice sets on the services
+func Service(node v1beta1.Node, services []v1beta1.Service) *v1beta1.Service {
+	for i, service := range services {
+		if service.ObjectMeta.Namespace != node.ObjectMeta.Namespace {
+			continue
+		}
+		for _, owner := range node.ObjectMeta.OwnerReferences {
+			if owner.UID == service.ObjectMeta.UID {
+				return &services[i]
+			}
+		}
+		if node.ObjectMeta.Labels[ServiceLabel] == App(service) {
+			return &services[i]
+		}
+	}
+	return nil
+}
+
+// App returns the app label of the nodes of the service: its own app label,
+// or its name when it has none
+func App(service v1beta1.Service) string {
+	app := service.ObjectMeta.Labels[ServiceLabel]
+	if app == "" {
+		app = service.ObjectMeta.Name
+	}
+	return app
+}
+
+// ServiceKey identifies the service across the namespaces
+func ServiceKey(service v1beta1.Service) string {
+	return service.ObjectMeta.Namespace + "/" + service.ObjectMeta.Name
+}
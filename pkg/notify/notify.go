@@ -0,0 +1,366 @@
+// Package notify tells external systems, e.g. a chat or a CMDB, about the
+// changes made through the gateway functions.
+//
+// The webhooks are configured in the Notifications secret:
+//
+//	{
+//	  "webhooks": [
+//	    {"url": "https://cmdb.example.com/hooks/automium", "secret": "..."},
+//	    {"url": "https://hooks.slack.com/services/...", "format": "slack"}
+//	  ]
+//	}
+//
+// Every event is POSTed as JSON to each webhook, signed with the secret of
+// the webhook in the X-Automium-Signature header (sha256=<HMAC-SHA256 of the
+// body>), and retried with exponential backoff on network errors and on 429
+// and 5xx answers, for at most the timeout of the configuration (10s by
+// default, overridden by the notify_timeout environment variable), so the
+// retries end before the function times out. The slack format POSTs a
+// {"text": ...} message instead, rendered from the template of the webhook.
+// JSON webhooks without a secret are rejected, since their receivers could not
+// trust the events. Without the Notifications secret, no notification is
+// sent.
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/automium/automium-gateway/pkg/logging"
+)
+
+// Types of the events
+const (
+	SpecSaved      = "spec.saved"
+	SpecDeleted    = "spec.deleted"
+	SpecPromoted   = "spec.promoted"
+	ServiceApplied = "service.applied"
+)
+
+// Formats of the webhooks
+const (
+	FormatJSON  = "json"
+	FormatSlack = "slack"
+)
+
+// Headers of the requests
+const (
+	SignatureHeader = "X-Automium-Signature"
+	EventHeader     = "X-Automium-Event"
+	DeliveryHeader  = "X-Automium-Delivery"
+)
+
+const (
+	secretPath = "/var/openfaas/secrets/Notifications"
+
+	defaultMaxAttempts    = 4
+	defaultInitialBackoff = 500 * time.Millisecond
+	defaultTimeout        = 10 * time.Second
+	maxBackoff            = 5 * time.Second
+	requestTimeout        = 5 * time.Second
+)
+
+// DefaultTemplate renders the Slack messages
+const DefaultTemplate = `[AUTOMIUM] {{.Summary}}{{if .Commit}} (commit {{.Commit}}){{end}}`
+
+// Event of a change
+type Event struct {
+	ID           string      `json:"id"`
+	Type         string      `json:"type"`
+	Time         time.Time   `json:"time"`
+	Function     string      `json:"function"`
+	RequestID    string      `json:"requestId,omitempty"`
+	Service      string      `json:"service"`
+	Namespace    string      `json:"namespace,omitempty"`
+	Commit       string      `json:"commit,omitempty"`
+	Source       string      `json:"source,omitempty"`
+	Target       string      `json:"target,omitempty"`
+	SourceCommit string      `json:"sourceCommit,omitempty"`
+	Object       interface{} `json:"object,omitempty"`
+}
+
+// Summary describes the event in a sentence
+func (e Event) Summary() string {
+	switch e.Type {
+	case SpecSaved:
+		return fmt.Sprintf("Spec of %s saved", e.Service)
+	case SpecDeleted:
+		return fmt.Sprintf("Spec of %s deleted", e.Service)
+	case SpecPromoted:
+		return fmt.Sprintf("Spec of %s promoted from %s to %s", e.Service, e.Source, e.Target)
+	case ServiceApplied:
+		return fmt.Sprintf("Service %s applied", e.Service)
+	}
+	return fmt.Sprintf("%s on %s", e.Type, e.Service)
+}
+
+// Webhook receiving the events
+type Webhook struct {
+	URL      string `json:"url"`
+	Secret   string `json:"secret"`
+	Format   string `json:"format"`
+	Template string `json:"template"`
+	// Events filters the types of events sent, all when empty
+	Events []string `json:"events"`
+}
+
+// Config of the notifications
+type Config struct {
+	Webhooks       []Webhook `json:"webhooks"`
+	MaxAttempts    int       `json:"maxAttempts"`
+	InitialBackoff string    `json:"initialBackoff"`
+	// Timeout bounds the deliveries of an event, retries included
+	Timeout string `json:"timeout"`
+}
+
+// LoadConfig reads the configuration from the Notifications secret
+func LoadConfig() (Config, error) {
+	var config Config
+
+	secretBytes, err := ioutil.ReadFile(secretPath)
+	if os.IsNotExist(err) {
+		return config, nil
+	}
+	if err != nil {
+		return config, err
+	}
+
+	err = json.Unmarshal(secretBytes, &config)
+	if err != nil {
+		return config, fmt.Errorf("invalid Notifications secret: %s", err.Error())
+	}
+	return config, nil
+}
+
+// Notifier sends the events of a function
+type Notifier struct {
+	function  string
+	requestID string
+	config    Config
+	backoff   time.Duration
+	timeout   time.Duration
+	client    *http.Client
+	logger    *logging.Logger
+}
+
+// New returns the notifier of the function, configured from the secret. A
+// configuration error disables the notifications, but never fails the
+// request.
+func New(function string) *Notifier {
+	config, err := LoadConfig()
+	if err != nil {
+		logging.New(function).Errorf("Notifications disabled: %s", err.Error())
+	}
+	return NewWithConfig(function, config)
+}
+
+// NewWithConfig returns a notifier of the function sending to the webhooks
+// of config. The invalid webhooks are logged and left out.
+func NewWithConfig(function string, config Config) *Notifier {
+	logger := logging.New(function)
+
+	var webhooks []Webhook
+	for _, webhook := range config.Webhooks {
+		err := webhook.validate()
+		if err != nil {
+			logger.Errorf("Webhook disabled: %s", err.Error())
+			continue
+		}
+		webhooks = append(webhooks, webhook)
+	}
+	config.Webhooks = webhooks
+
+	if config.MaxAttempts <= 0 {
+		config.MaxAttempts = defaultMaxAttempts
+	}
+	backoff, err := time.ParseDuration(config.InitialBackoff)
+	if err != nil || backoff <= 0 {
+		backoff = defaultInitialBackoff
+	}
+	if timeout := os.Getenv("notify_timeout"); timeout != "" {
+		config.Timeout = timeout
+	}
+	timeout, err := time.ParseDuration(config.Timeout)
+	if err != nil || timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	return &Notifier{
+		function: function,
+		config:   config,
+		backoff:  backoff,
+		timeout:  timeout,
+		client:   &http.Client{Timeout: requestTimeout},
+		logger:   logger,
+	}
+}
+
+// SetRequestID sets the ID of the request the events belong to
+func (n *Notifier) SetRequestID(requestID string) {
+	n.requestID = requestID
+}
+
+// Send delivers the event to every webhook, and waits for the deliveries:
+// the processes of the classic watchdog exit after the request. The
+// deliveries give up at the timeout of the notifier, and a failed delivery is
+// logged, since the change is already done.
+func (n *Notifier) Send(event Event) {
+	if len(n.config.Webhooks) == 0 {
+		return
+	}
+
+	event.ID = newID()
+	event.Time = time.Now().UTC()
+	event.Function = n.function
+	event.RequestID = n.requestID
+	deadline := time.Now().Add(n.timeout)
+
+	var wg sync.WaitGroup
+	for _, webhook := range n.config.Webhooks {
+		if !webhook.accepts(event.Type) {
+			continue
+		}
+		wg.Add(1)
+		go func(webhook Webhook) {
+			defer wg.Done()
+			err := n.deliver(webhook, event, deadline)
+			if err != nil {
+				n.logger.Errorf("Cannot notify %s to %s: %s", event.Type, webhook.URL, err.Error())
+			}
+		}(webhook)
+	}
+	wg.Wait()
+}
+
+// validate checks the webhook can receive the events: JSON events must be
+// signed, so the receiver can trust them
+func (w Webhook) validate() error {
+	if w.URL == "" {
+		return fmt.Errorf("webhook without url")
+	}
+	if w.Format != FormatSlack && w.Secret == "" {
+		return fmt.Errorf("webhook %s has no secret to sign the events", w.URL)
+	}
+	return nil
+}
+
+func (w Webhook) accepts(eventType string) bool {
+	if len(w.Events) == 0 {
+		return true
+	}
+	for _, accepted := range w.Events {
+		if accepted == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// deliver posts the event to the webhook, retrying until the deadline
+func (n *Notifier) deliver(webhook Webhook, event Event, deadline time.Time) error {
+	body, err := Body(webhook, event)
+	if err != nil {
+		return err
+	}
+
+	backoff := n.backoff
+	for attempt := 1; ; attempt++ {
+		retry, err := n.post(webhook, event, body, deadline)
+		if err == nil {
+			return nil
+		}
+		if !retry || attempt >= n.config.MaxAttempts {
+			return fmt.Errorf("attempt %d: %s", attempt, err.Error())
+		}
+		if time.Now().Add(backoff).After(deadline) {
+			return fmt.Errorf("attempt %d: %s, no time left to retry", attempt, err.Error())
+		}
+
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// post sends the body once, and tells if a failure is worth a retry
+func (n *Notifier) post(webhook Webhook, event Event, body []byte, deadline time.Time) (bool, error) {
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	request, err := http.NewRequest(http.MethodPost, webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	request = request.WithContext(ctx)
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(EventHeader, event.Type)
+	request.Header.Set(DeliveryHeader, event.ID)
+	if webhook.Secret != "" {
+		request.Header.Set(SignatureHeader, Sign(webhook.Secret, body))
+	}
+
+	response, err := n.client.Do(request)
+	if err != nil {
+		return true, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode >= 300 {
+		retry := response.StatusCode == http.StatusTooManyRequests || response.StatusCode >= 500
+		return retry, fmt.Errorf("unexpected status %s", response.Status)
+	}
+	return false, nil
+}
+
+// Body renders the event in the format of the webhook
+func Body(webhook Webhook, event Event) ([]byte, error) {
+	if webhook.Format != FormatSlack {
+		return json.Marshal(event)
+	}
+
+	text := webhook.Template
+	if text == "" {
+		text = DefaultTemplate
+	}
+	tmpl, err := template.New("message").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid template: %s", err.Error())
+	}
+
+	var message bytes.Buffer
+	err = tmpl.Execute(&message, event)
+	if err != nil {
+		return nil, fmt.Errorf("cannot render template: %s", err.Error())
+	}
+	return json.Marshal(map[string]string{"text": message.String()})
+}
+
+// Sign returns the signature of the body, as sent in the X-Automium-Signature
+// header
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func newID() string {
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	if err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(id)
+}
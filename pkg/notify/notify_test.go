@@ -0,0 +1,177 @@
+package notify
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSign(t *testing.T) {
+	tests := []struct {
+		secret   string
+		body     string
+		expected string
+	}{
+		{"key", "The quick brown fox jumps over the lazy dog", "sha256=f7bc83f430538424b13298e6aa6fb143ef4d59a14946175997479dbc2d1a3cd8"},
+		{"", "", "sha256=b613679a0814d9ec772f95d778c35fc5ff1697c493715653c6c712144292c5ad"},
+	}
+
+	for _, test := range tests {
+		if actual := Sign(test.secret, []byte(test.body)); actual != test.expected {
+			t.Errorf("%q, %q: expected %s, got %s", test.secret, test.body, test.expected, actual)
+		}
+	}
+}
+
+func TestNewWithConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		webhooks []Webhook
+		expected []string
+	}{
+		{"signed", []Webhook{{URL: "http://cmdb", Secret: "s3cr3t"}}, []string{"http://cmdb"}},
+		{"unsigned json", []Webhook{{URL: "http://cmdb"}, {URL: "http://other", Format: FormatJSON}}, nil},
+		{"unsigned slack", []Webhook{{URL: "http://slack", Format: FormatSlack}}, []string{"http://slack"}},
+		{"without url", []Webhook{{Secret: "s3cr3t"}, {URL: "http://cmdb", Secret: "s3cr3t"}}, []string{"http://cmdb"}},
+	}
+
+	for _, test := range tests {
+		notifier := NewWithConfig("savespec", Config{Webhooks: test.webhooks})
+		var actual []string
+		for _, webhook := range notifier.config.Webhooks {
+			actual = append(actual, webhook.URL)
+		}
+		if len(actual) != len(test.expected) {
+			t.Errorf("%s: expected webhooks %v, got %v", test.name, test.expected, actual)
+			continue
+		}
+		for i := range actual {
+			if actual[i] != test.expected[i] {
+				t.Errorf("%s: expected webhooks %v, got %v", test.name, test.expected, actual)
+			}
+		}
+	}
+}
+
+func TestSend(t *testing.T) {
+	var mu sync.Mutex
+	var signature, eventType string
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		signature = r.Header.Get(SignatureHeader)
+		eventType = r.Header.Get(EventHeader)
+		body, _ = ioutil.ReadAll(r.Body)
+	}))
+	defer server.Close()
+
+	notifier := NewWithConfig("savespec", Config{Webhooks: []Webhook{{URL: server.URL, Secret: "s3cr3t"}}})
+	notifier.SetRequestID("42")
+	notifier.Send(Event{Type: SpecSaved, Service: "web", Commit: "4b825dc6"})
+
+	mu.Lock()
+	defer mu.Unlock()
+	if signature != Sign("s3cr3t", body) {
+		t.Errorf("expected the signature of %s, got %s", body, signature)
+	}
+	var event Event
+	err := json.Unmarshal(body, &event)
+	if err != nil {
+		t.Fatalf("invalid body %s", body)
+	}
+	if eventType != SpecSaved || event.Type != SpecSaved || event.Function != "savespec" || event.RequestID != "42" || event.ID == "" {
+		t.Errorf("unexpected event %s: %+v", eventType, event)
+	}
+}
+
+func TestDeliver(t *testing.T) {
+	tests := []struct {
+		name      string
+		statuses  []int
+		attempts  int
+		timeout   string
+		shouldErr bool
+	}{
+		{"delivered", []int{http.StatusOK}, 1, "", false},
+		{"retried on 5xx", []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusOK}, 3, "", false},
+		{"retried on 429", []int{http.StatusTooManyRequests, http.StatusOK}, 2, "", false},
+		{"not retried on 4xx", []int{http.StatusBadRequest, http.StatusOK}, 1, "", true},
+		{"attempts exhausted", []int{500, 500, 500, 500, 500}, 4, "", true},
+		{"timeout exhausted", []int{500, 500, 500, 500, 500}, 2, "15ms", true},
+	}
+
+	for _, test := range tests {
+		var attempts int
+		var times []time.Time
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			times = append(times, time.Now())
+			w.WriteHeader(test.statuses[attempts])
+			attempts++
+		}))
+
+		notifier := NewWithConfig("savespec", Config{InitialBackoff: "10ms", Timeout: test.timeout})
+		webhook := Webhook{URL: server.URL, Secret: "s3cr3t"}
+		err := notifier.deliver(webhook, Event{Type: SpecSaved}, time.Now().Add(notifier.timeout))
+		server.Close()
+
+		if (err != nil) != test.shouldErr {
+			t.Errorf("%s: expected error %t, got %v", test.name, test.shouldErr, err)
+		}
+		if attempts != test.attempts {
+			t.Errorf("%s: expected %d attempts, got %d", test.name, test.attempts, attempts)
+		}
+		// the backoff doubles at every retry
+		for i := 1; i < len(times); i++ {
+			minimum := 10 * time.Millisecond << uint(i-1)
+			if elapsed := times[i].Sub(times[i-1]); elapsed < minimum {
+				t.Errorf("%s: retry %d after %s, expected at least %s", test.name, i, elapsed, minimum)
+			}
+		}
+	}
+}
+
+func TestBody(t *testing.T) {
+	tests := []struct {
+		name     string
+		webhook  Webhook
+		expected string
+	}{
+		{"slack default template", Webhook{Format: FormatSlack}, `{"text":"[AUTOMIUM] Spec of web saved (commit 4b825dc6)"}`},
+		{"slack template", Webhook{Format: FormatSlack, Template: "{{.Type}} {{.Service}}"}, `{"text":"spec.saved web"}`},
+	}
+
+	for _, test := range tests {
+		body, err := Body(test.webhook, Event{Type: SpecSaved, Service: "web", Commit: "4b825dc6"})
+		if err != nil {
+			t.Errorf("%s: Body returned %s", test.name, err.Error())
+			continue
+		}
+		if string(body) != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.name, test.expected, body)
+		}
+	}
+}
+
+func TestSummary(t *testing.T) {
+	tests := []struct {
+		event    Event
+		expected string
+	}{
+		{Event{Type: SpecSaved, Service: "web"}, "Spec of web saved"},
+		{Event{Type: SpecDeleted, Service: "web"}, "Spec of web deleted"},
+		{Event{Type: SpecPromoted, Service: "web", Source: "staging", Target: "production"}, "Spec of web promoted from staging to production"},
+		{Event{Type: ServiceApplied, Service: "web"}, "Service web applied"},
+		{Event{Type: "service.scaled", Service: "web"}, "service.scaled on web"},
+	}
+
+	for _, test := range tests {
+		if summary := test.event.Summary(); summary != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.event.Type, test.expected, summary)
+		}
+	}
+}
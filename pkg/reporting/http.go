@@ -0,0 +1,29 @@
+package reporting
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/automium/automium-gateway/pkg/apikey"
+)
+
+type contextKey struct{}
+
+// Instrument wraps the handler of a function built on the HTTP watchdog,
+// making a Reporter tagged with the API key ID available through FromRequest
+func Instrument(function string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		reporter := New(function)
+		reporter.Tag("keyId", apikey.ID(r.Header.Get("X-Api-Key")))
+		next(w, r.WithContext(context.WithValue(r.Context(), contextKey{}, reporter)))
+	}
+}
+
+// FromRequest returns the Reporter of a request served through Instrument
+func FromRequest(r *http.Request) *Reporter {
+	reporter, ok := r.Context().Value(contextKey{}).(*Reporter)
+	if !ok {
+		return New("unknown")
+	}
+	return reporter
+}
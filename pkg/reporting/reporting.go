@@ -0,0 +1,168 @@
+// Package reporting sends the errors of the gateway functions to an error
+// tracker, together with the context of the request that failed.
+//
+// The tracker is configured from the ErrorReporting secret, a JSON document
+// with the provider, dsn, environment and release keys, and from the
+// error_reporting_* environment variables, which take precedence. Reporting
+// is disabled when no DSN is configured or the provider is "none".
+package reporting
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/automium/automium-gateway/pkg/logging"
+)
+
+const (
+	secretPath      = "/var/openfaas/secrets/ErrorReporting"
+	defaultProvider = "sentry"
+	disabled        = "none"
+)
+
+// Config of the error tracker
+type Config struct {
+	Provider    string `json:"provider"`
+	DSN         string `json:"dsn"`
+	Environment string `json:"environment"`
+	Release     string `json:"release"`
+}
+
+// Backend delivers the errors to an error tracker
+type Backend interface {
+	Capture(err error, tags map[string]string)
+}
+
+// Factory creates the backend of a provider
+type Factory func(config Config) (Backend, error)
+
+var (
+	factoriesMu sync.Mutex
+	factories   = map[string]Factory{}
+
+	backendOnce sync.Once
+	backend     Backend
+)
+
+// Register makes a provider available by name
+func Register(provider string, factory Factory) {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+	factories[provider] = factory
+}
+
+// LoadConfig reads the configuration from the secret and the environment
+func LoadConfig() (Config, error) {
+	var config Config
+
+	secretBytes, err := ioutil.ReadFile(secretPath)
+	if err == nil {
+		err = json.Unmarshal(secretBytes, &config)
+		if err != nil {
+			return config, fmt.Errorf("invalid ErrorReporting secret: %s", err.Error())
+		}
+	} else if !os.IsNotExist(err) {
+		return config, err
+	}
+
+	overrides := map[string]*string{
+		"error_reporting_provider":    &config.Provider,
+		"error_reporting_dsn":         &config.DSN,
+		"error_reporting_environment": &config.Environment,
+		"error_reporting_release":     &config.Release,
+	}
+	for name, field := range overrides {
+		if value := os.Getenv(name); value != "" {
+			*field = value
+		}
+	}
+
+	if config.Provider == "" {
+		config.Provider = defaultProvider
+	}
+	config.Provider = strings.ToLower(config.Provider)
+	return config, nil
+}
+
+// defaultBackend returns the backend of the process, created on first use.
+// A configuration error disables reporting, but never fails the request: it
+// is logged with the logger of the first request reporting an error.
+func defaultBackend(logger *logging.Logger) Backend {
+	backendOnce.Do(func() {
+		config, err := LoadConfig()
+		if err != nil {
+			logger.Errorf("Error reporting disabled: %s", err.Error())
+			return
+		}
+		if config.DSN == "" || config.Provider == disabled {
+			return
+		}
+
+		factoriesMu.Lock()
+		factory, ok := factories[config.Provider]
+		factoriesMu.Unlock()
+		if !ok {
+			logger.Errorf("Error reporting disabled: unknown provider %s", config.Provider)
+			return
+		}
+
+		backend, err = factory(config)
+		if err != nil {
+			logger.Errorf("Error reporting disabled: %s", err.Error())
+			backend = nil
+		}
+	})
+	return backend
+}
+
+// Reporter reports the errors of a request, tagged with its context
+type Reporter struct {
+	mu     sync.Mutex
+	tags   map[string]string
+	logger *logging.Logger
+}
+
+// New returns a reporter for a request to the function
+func New(function string) *Reporter {
+	return &Reporter{tags: map[string]string{"function": function}, logger: logging.New(function)}
+}
+
+// Tag adds context to the reported errors. Tags must never carry secrets:
+// identify the API key with apikey.ID.
+func (r *Reporter) Tag(name string, value string) {
+	if value == "" {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.tags[name] = value
+	// the tags are the logging fields, so the errors of the reporter itself
+	// are logged with them
+	r.logger.Set(name, value)
+}
+
+// Report sends the error to the tracker, when reporting is enabled
+func (r *Reporter) Report(err error) {
+	backend := defaultBackend(r.logger)
+	if backend == nil || err == nil {
+		return
+	}
+
+	r.mu.Lock()
+	tags := make(map[string]string, len(r.tags))
+	for name, value := range r.tags {
+		tags[name] = value
+	}
+	r.mu.Unlock()
+
+	backend.Capture(err, tags)
+}
+
+// Reportf reports a formatted error
+func (r *Reporter) Reportf(format string, v ...interface{}) {
+	r.Report(fmt.Errorf(format, v...))
+}
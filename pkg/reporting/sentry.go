@@ -0,0 +1,29 @@
+package reporting
+
+import (
+	"github.com/getsentry/raven-go"
+)
+
+func init() {
+	Register("sentry", newSentry)
+}
+
+type sentry struct {
+	client *raven.Client
+}
+
+func newSentry(config Config) (Backend, error) {
+	client, err := raven.New(config.DSN)
+	if err != nil {
+		return nil, err
+	}
+	client.SetEnvironment(config.Environment)
+	client.SetRelease(config.Release)
+	return &sentry{client: client}, nil
+}
+
+// Capture waits for the delivery: the classic watchdog exits right after a
+// failed request
+func (s *sentry) Capture(err error, tags map[string]string) {
+	s.client.CaptureErrorAndWait(err, tags)
+}
@@ -0,0 +1,78 @@
+// Package services applies the Automium Services described by the gateway
+// requests, so applyservice, bulkapply and gitwebhook create and update them
+// the same way.
+package services
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/automium/automium-gateway/pkg/metrics"
+	types "github.com/automium/types/go/gateway"
+	v1beta1 "github.com/automium/types/go/v1beta1"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/rest"
+)
+
+// Namespace of the services applied through the gateway
+const Namespace = "default"
+
+// New returns the service described by the request
+func New(input types.ApplyService) *v1beta1.Service {
+	return &v1beta1.Service{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: input.Service.APIVersion,
+			Kind:       input.Service.Kind,
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   input.Service.Metadata.Name,
+			Labels: map[string]string{"app": input.Service.Metadata.Labels.App},
+		},
+		Spec: v1beta1.ServiceSpec{
+			Replicas: input.Service.Spec.Replicas,
+			Flavor:   input.Service.Spec.Flavor,
+			Version:  input.Service.Spec.Version,
+			Tags:     input.Service.Spec.Tags,
+			Env:      input.Service.Spec.Env,
+		},
+	}
+}
+
+// Apply creates the service described by the request, or updates it when it
+// already exists. Each call to Kubernetes is a phase of the recorder, and
+// ctx cancels them.
+func Apply(ctx context.Context, client *rest.RESTClient, recorder *metrics.Recorder, input types.ApplyService) (v1beta1.Service, error) {
+	var result = v1beta1.Service{}
+	service := New(input)
+	name := service.ObjectMeta.Name
+
+	phase := recorder.KubernetesPhase("POST", "services", name)
+	err := client.Post().Context(ctx).Resource("services").Namespace(Namespace).Body(service).Do().Into(&result)
+	if err != nil && !errors.IsAlreadyExists(err) {
+		phase.Done(err)
+		return result, fmt.Errorf("cannot create service: %s", err.Error())
+	}
+	// an existing service is not a failed call, it is updated below
+	phase.Done(nil)
+	if err == nil {
+		return result, nil
+	}
+
+	phase = recorder.KubernetesPhase("GET", "services", name)
+	err = client.Get().Context(ctx).Resource("services").Name(name).Namespace(Namespace).Do().Into(&result)
+	phase.Done(err)
+	if err != nil {
+		return result, fmt.Errorf("cannot get service: %s", err.Error())
+	}
+
+	service.ObjectMeta.ResourceVersion = result.ObjectMeta.ResourceVersion
+	phase = recorder.KubernetesPhase("PUT", "services", name)
+	err = client.Put().Context(ctx).Resource("services").Name(name).Namespace(Namespace).Body(service).Do().Into(&result)
+	phase.Done(err)
+	if err != nil {
+		return result, fmt.Errorf("cannot update service: %s", err.Error())
+	}
+	return result, nil
+}
@@ -0,0 +1,116 @@
+// Package specs locates the service specs in the Git repository.
+//
+// The layout is read from the "specs" key of the GitConfig secret:
+//
+//	{
+//	  "git": {...},
+//	  "specs": {"root": "services", "pattern": "*.yaml"}
+//	}
+//
+// The specs are the files of the root directory matching the pattern, whose
+// only "*" stands for the lowercase name of the service. Without a layout,
+// the specs are the <name>.yaml files of the repository root.
+package specs
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// DefaultPattern names the spec files when no pattern is configured
+const DefaultPattern = "*.yaml"
+
+// nameRegexp matches the DNS-1123 subdomains Kubernetes accepts as names
+var nameRegexp = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?(\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*$`)
+
+// Layout of the specs in the repository
+type Layout struct {
+	Root    string `json:"root"`
+	Pattern string `json:"pattern"`
+}
+
+// Validate checks the root stays in the repository and the pattern has a
+// single "*" for the name
+func (l Layout) Validate() error {
+	dir := l.Dir()
+	if dir == ".." || strings.HasPrefix(dir, "../") {
+		return fmt.Errorf("spec root %s is outside the repository", l.Root)
+	}
+
+	pattern := l.pattern()
+	if strings.Count(pattern, "*") != 1 {
+		return fmt.Errorf("spec pattern %s must have a single *", pattern)
+	}
+	if strings.ContainsAny(pattern, "/?[\\") {
+		return fmt.Errorf("spec pattern %s can only have a * wildcard", pattern)
+	}
+	return nil
+}
+
+func (l Layout) pattern() string {
+	if l.Pattern == "" {
+		return DefaultPattern
+	}
+	return l.Pattern
+}
+
+// Dir returns the directory of the specs, relative to the repository: empty
+// for the root
+func (l Layout) Dir() string {
+	dir := path.Clean(strings.Trim(l.Root, "/"))
+	if dir == "." {
+		return ""
+	}
+	return dir
+}
+
+// ValidateName checks the service name is a Kubernetes name, so its spec
+// stays in the spec directory
+func ValidateName(service string) error {
+	if strings.ContainsAny(service, "/\\") || strings.Contains(service, "..") {
+		return fmt.Errorf("service name %s cannot be a path", service)
+	}
+	name := strings.ToLower(service)
+	if len(name) > 253 || !nameRegexp.MatchString(name) {
+		return fmt.Errorf("service name %s must be a DNS-1123 subdomain", service)
+	}
+	return nil
+}
+
+// Path returns the path of the spec of the service, relative to the
+// repository, or an error when the name is not valid
+func (l Layout) Path(service string) (string, error) {
+	err := ValidateName(service)
+	if err != nil {
+		return "", err
+	}
+	return path.Join(l.Dir(), strings.Replace(l.pattern(), "*", strings.ToLower(service), 1)), nil
+}
+
+// Name returns the name of the service of the spec at file, relative to the
+// repository, and whether file is a spec at all
+func (l Layout) Name(file string) (string, bool) {
+	dir, base := path.Split(file)
+	if strings.TrimSuffix(dir, "/") != l.Dir() {
+		return "", false
+	}
+
+	pattern := l.pattern()
+	star := strings.Index(pattern, "*")
+	if star < 0 {
+		return "", false
+	}
+	prefix, suffix := pattern[:star], pattern[star+1:]
+	if len(base) <= len(prefix)+len(suffix) || !strings.HasPrefix(base, prefix) || !strings.HasSuffix(base, suffix) {
+		return "", false
+	}
+	return base[len(prefix) : len(base)-len(suffix)], true
+}
+
+// Match tells if file, relative to the repository, is a spec
+func (l Layout) Match(file string) bool {
+	_, ok := l.Name(file)
+	return ok
+}
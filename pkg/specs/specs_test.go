@@ -0,0 +1,111 @@
+package specs
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name      string
+		layout    Layout
+		shouldErr bool
+	}{
+		{"default layout", Layout{}, false},
+		{"root and pattern", Layout{Root: "services", Pattern: "service-*.yml"}, false},
+		{"nested root", Layout{Root: "/deploy/services/"}, false},
+		{"root outside", Layout{Root: "../services"}, true},
+		{"root outside after cleaning", Layout{Root: "services/../../other"}, true},
+		{"parent root", Layout{Root: ".."}, true},
+		{"no star", Layout{Pattern: "service.yaml"}, true},
+		{"two stars", Layout{Pattern: "*-*.yaml"}, true},
+		{"directory in pattern", Layout{Pattern: "*/spec.yaml"}, true},
+		{"other wildcard", Layout{Pattern: "*.y?ml"}, true},
+		{"character class", Layout{Pattern: "*.[jy]aml"}, true},
+	}
+
+	for _, test := range tests {
+		err := test.layout.Validate()
+		if test.shouldErr && err == nil {
+			t.Errorf("%s: expected an error, got nil", test.name)
+		}
+		if !test.shouldErr && err != nil {
+			t.Errorf("%s: expected no error, got %s", test.name, err.Error())
+		}
+	}
+}
+
+func TestDir(t *testing.T) {
+	tests := []struct {
+		root     string
+		expected string
+	}{
+		{"", ""},
+		{"/", ""},
+		{".", ""},
+		{"services", "services"},
+		{"/services/", "services"},
+		{"deploy//services", "deploy/services"},
+		{"deploy/../services", "services"},
+	}
+
+	for _, test := range tests {
+		if dir := (Layout{Root: test.root}).Dir(); dir != test.expected {
+			t.Errorf("%q: expected %q, got %q", test.root, test.expected, dir)
+		}
+	}
+}
+
+func TestPath(t *testing.T) {
+	tests := []struct {
+		name      string
+		layout    Layout
+		service   string
+		expected  string
+		shouldErr bool
+	}{
+		{"default layout", Layout{}, "web", "web.yaml", false},
+		{"lowercase name", Layout{}, "Web", "web.yaml", false},
+		{"root", Layout{Root: "services"}, "web", "services/web.yaml", false},
+		{"root and pattern", Layout{Root: "/services/", Pattern: "service-*.yml"}, "web", "services/service-web.yml", false},
+		{"dotted name", Layout{}, "web.eu-west", "web.eu-west.yaml", false},
+		{"slash", Layout{Root: "services"}, "../web", "", true},
+		{"nested name", Layout{}, "other/web", "", true},
+		{"backslash", Layout{}, "..\\web", "", true},
+		{"dot dot", Layout{}, "web..yaml", "", true},
+		{"parent", Layout{}, "..", "", true},
+		{"empty name", Layout{}, "", "", true},
+		{"underscore", Layout{}, "web_1", "", true},
+		{"leading dash", Layout{}, "-web", "", true},
+		{"too long", Layout{}, strings.Repeat("a", 254), "", true},
+	}
+
+	for _, test := range tests {
+		p, err := test.layout.Path(test.service)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %s", test.name, p)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: expected no error, got %s", test.name, err.Error())
+		} else if p != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.name, test.expected, p)
+		}
+	}
+}
+
+func TestPathName(t *testing.T) {
+	layouts := []Layout{{}, {Root: "services"}, {Root: "/deploy/services/", Pattern: "service-*.yml"}}
+
+	for _, layout := range layouts {
+		file, err := layout.Path("web")
+		if err != nil {
+			t.Errorf("%+v: expected no error, got %s", layout, err.Error())
+		}
+		if name, ok := layout.Name(file); !ok || name != "web" {
+			t.Errorf("%+v: expected %s to be the spec of web, got %q, %t", layout, file, name, ok)
+		}
+	}
+}
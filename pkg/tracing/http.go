@@ -0,0 +1,29 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+
+	"go.opentelemetry.io/otel/propagation"
+)
+
+type contextKey struct{}
+
+// Instrument wraps the handler of a function built on the HTTP watchdog,
+// tracing every request and making its Trace available through FromRequest
+func Instrument(function string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		t := start(r.Context(), function, propagation.HeaderCarrier(r.Header))
+		defer t.End()
+		next(w, r.WithContext(context.WithValue(t.Context(), contextKey{}, t)))
+	}
+}
+
+// FromRequest returns the Trace of a request served through Instrument
+func FromRequest(r *http.Request) *Trace {
+	t, ok := r.Context().Value(contextKey{}).(*Trace)
+	if !ok {
+		return Start("unknown", propagation.HeaderCarrier(r.Header))
+	}
+	return t
+}
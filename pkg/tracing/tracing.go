@@ -0,0 +1,205 @@
+// Package tracing traces the requests served by the gateway functions with
+// OpenTelemetry: a span for the request, continuing the W3C trace context of
+// the caller, and a span for each of its phases.
+//
+// The exporter is chosen with the tracing_exporter environment variable:
+// otlp sends the spans over OTLP/HTTP to tracing_endpoint (or to the standard
+// OTEL_EXPORTER_OTLP_* endpoint), stdout writes them to stderr, since stdout
+// carries the response of the classic watchdog, and none disables tracing.
+// Without tracing_exporter, otlp is used when an endpoint is set, none
+// otherwise.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/automium/automium-gateway/pkg/logging"
+	"github.com/automium/automium-gateway/pkg/metrics"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Exporters of the spans
+const (
+	ExporterOTLP   = "otlp"
+	ExporterStdout = "stdout"
+	ExporterNone   = "none"
+)
+
+const (
+	instrumentationName = "github.com/automium/automium-gateway"
+	serviceName         = "automium-gateway"
+	flushTimeout        = 5 * time.Second
+)
+
+var (
+	setupOnce sync.Once
+	provider  *sdktrace.TracerProvider
+	logger    *logging.Logger
+)
+
+// setup installs the W3C propagator and the tracer provider of the process
+func setup(function string) {
+	setupOnce.Do(func() {
+		logger = logging.New(function)
+		otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+		exporter, err := newExporter()
+		if err != nil {
+			// tracing must never fail a request
+			logger.Errorf("Tracing disabled: %s", err.Error())
+			return
+		}
+		if exporter == nil {
+			return
+		}
+
+		provider = sdktrace.NewTracerProvider(
+			sdktrace.WithBatcher(exporter),
+			sdktrace.WithResource(resource.NewSchemaless(
+				attribute.String("service.name", serviceName),
+				attribute.String("faas.name", function),
+			)),
+		)
+		otel.SetTracerProvider(provider)
+	})
+}
+
+func newExporter() (sdktrace.SpanExporter, error) {
+	endpoint := os.Getenv("tracing_endpoint")
+
+	exporter := strings.ToLower(os.Getenv("tracing_exporter"))
+	if exporter == "" {
+		exporter = ExporterNone
+		if endpoint != "" || os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" || os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") != "" {
+			exporter = ExporterOTLP
+		}
+	}
+
+	switch exporter {
+	case ExporterOTLP:
+		var options []otlptracehttp.Option
+		if endpoint != "" {
+			options = append(options, otlptracehttp.WithEndpointURL(endpoint))
+		}
+		return otlptracehttp.New(context.Background(), options...)
+	case ExporterStdout:
+		return stdouttrace.New(stdouttrace.WithWriter(os.Stderr))
+	case ExporterNone:
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unknown exporter %s", exporter)
+}
+
+// Trace is the trace of a request
+type Trace struct {
+	ctx   context.Context
+	span  trace.Span
+	flush bool
+}
+
+// Start traces a request to the function, continuing the trace context
+// carried by the request headers
+func Start(function string, carrier propagation.TextMapCarrier) *Trace {
+	return start(context.Background(), function, carrier)
+}
+
+func start(parent context.Context, function string, carrier propagation.TextMapCarrier) *Trace {
+	setup(function)
+
+	ctx := otel.GetTextMapPropagator().Extract(parent, carrier)
+	ctx, span := otel.Tracer(instrumentationName).Start(ctx, function, trace.WithSpanKind(trace.SpanKindServer))
+	return &Trace{ctx: ctx, span: span}
+}
+
+// FromEnv traces the request served by a process of the classic watchdog,
+// which passes the request headers as Http_ environment variables. The
+// process exits after the request, so End also flushes the spans.
+func FromEnv(function string) *Trace {
+	carrier := propagation.MapCarrier{
+		"traceparent": os.Getenv("Http_Traceparent"),
+		"tracestate":  os.Getenv("Http_Tracestate"),
+		"baggage":     os.Getenv("Http_Baggage"),
+	}
+	t := Start(function, carrier)
+	t.flush = true
+	return t
+}
+
+// Context returns the context of the request span, to propagate it
+func (t *Trace) Context() context.Context {
+	return t.ctx
+}
+
+// SetAttribute adds context to the request span. Attributes must never carry
+// secrets: identify the API key with apikey.ID.
+func (t *Trace) SetAttribute(name string, value string) {
+	if value == "" {
+		return
+	}
+	t.span.SetAttributes(attribute.String(name, value))
+}
+
+// Phase starts the span of a phase of the request, and returns the function
+// ending it. The span is named after the phase and its operation, e.g.
+// "k8s POST services", and carries the attributes of the phase. It is meant
+// to be registered with the OnPhase of the metrics recorder of the request.
+func (t *Trace) Phase(name string, attributes map[string]string) func(err error) {
+	spanName := name
+	if operation := attributes[metrics.AttributeOperation]; operation != "" {
+		spanName = name + " " + operation
+	}
+
+	var spanAttributes []attribute.KeyValue
+	for key, value := range attributes {
+		spanAttributes = append(spanAttributes, attribute.String(key, value))
+	}
+
+	_, span := otel.Tracer(instrumentationName).Start(t.ctx, spanName, trace.WithAttributes(spanAttributes...))
+	return func(err error) {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}
+}
+
+// Fail marks the request as failed
+func (t *Trace) Fail(err error) {
+	t.span.RecordError(err)
+	t.span.SetStatus(codes.Error, err.Error())
+}
+
+// End ends the request span
+func (t *Trace) End() {
+	t.span.End()
+	if t.flush {
+		Flush()
+	}
+}
+
+// Flush exports the pending spans, before a process exits
+func Flush() {
+	if provider == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), flushTimeout)
+	defer cancel()
+	err := provider.ForceFlush(ctx)
+	if err != nil {
+		logger.Errorf("Cannot export spans: %s", err.Error())
+	}
+}